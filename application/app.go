@@ -1,13 +1,27 @@
 package application
 
 import (
+	"sync"
+
+	"warden/deploy"
 	"warden/docker"
 	"warden/store"
 )
 
+// Builds the images of the instances. Implemented by docker.Client
+type imageBuilder interface {
+	QueueBuild(id string, options docker.ImageBuildOptions, done func(hash string, err error)) error
+	QueuePosition(id string) int
+	ImageDigest(name, hash string) (string, error)
+}
+
 type App struct {
-	dck *docker.Client
+	dck imageBuilder
 	db  *store.Store
+	mgr deploy.Manager
+
+	deployLock sync.Mutex    // held while deploying or reconciling instances
+	stop       chan struct{} // closed when the app closes
 }
 
 // Creates a new App object
@@ -20,16 +34,30 @@ func NewApp() *App {
 	_db, err := store.NewStore()
 	fatalIfError(err)
 
+	_mgr, err := deploy.NewManager()
+	fatalIfError(err)
+
 	app := &App{
 		dck: _dck,
 		db:  _db,
+		mgr: _mgr,
+
+		stop: make(chan struct{}),
 	}
+	app.startReconciler()
+	app.resumePipelines()
+	go app.recordMirrors()
 
 	return app
 }
 
 func (a *App) Close() {
-	err := a.db.Close()
+	close(a.stop)
+
+	err := a.mgr.Close()
+	fatalIfError(err)
+
+	err = a.db.Close()
 	fatalIfError(err)
 
 	// Ignoring docker close
@@ -1,18 +1,76 @@
 package application
 
 import (
+	"io"
 	"net/http"
 
-	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+
+	"warden/deploy"
 )
 
-// Executes the function specified
+// Status logged for requests whose client went away before the instance responded.
+// Nothing is sent to the client as it is no longer there to receive it
+const statusClientClosedRequest = 499
+
+// Executes the function specified. The path after the project and alias is forwarded
+// to the instance with the request's method. The instance's status code, headers and
+// body are streamed back to the caller as they arrive
 func (a *App) ExecuteInstance(w http.ResponseWriter, r *http.Request) {
-	project := chi.URLParam(r, "project")
-	alias := chi.URLParam(r, "alias")
-	if alias == "" {
-		alias = "latest"
+	resp, err := a.mgr.RunInstance(r)
+	if err != nil {
+		switch errors.Cause(err) {
+		case deploy.ErrInstanceNotFound:
+			notFound(w, err)
+		case deploy.ErrInstanceUnreachable:
+			badGateway(w, err)
+		case deploy.ErrInstanceTimeout:
+			gatewayTimeout(w, err)
+		case deploy.ErrMethodNotAllowed:
+			methodNotAllowed(w, err)
+		case deploy.ErrInvalidRequest:
+			badRequest(w, err)
+		case deploy.ErrRequestCancelled:
+			w.WriteHeader(statusClientClosedRequest)
+		default:
+			internalServerError(w, err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
 	}
+	deploy.RemoveHopHeaders(header)
+	w.WriteHeader(resp.StatusCode)
 
-	panic(project)
+	// Status and headers are already sent at this point, so there is nothing more
+	// we can tell the client if streaming the body fails
+	_ = streamBody(w, resp.Body)
+}
+
+// Copies the body to the response writer, flushing after every read so that
+// the client receives the instance's output as it is produced
+func streamBody(w http.ResponseWriter, body io.Reader) error {
+	flusher, canFlush := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,53 @@
+package application
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"warden/deploy"
+	"warden/store/model"
+)
+
+// Records the results of the requests mirrored to shadow aliases until the app is
+// closed
+func (a *App) recordMirrors() {
+	results := deploy.MirrorResults()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case r := <-results:
+			if err := a.recordMirror(r); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (a *App) recordMirror(r deploy.MirrorResult) error {
+	proj, err := a.db.ProjectGetByName(r.Project)
+	if err != nil {
+		return errors.Wrapf(err, "error recording mirror result of project '%s'", r.Project)
+	}
+	return a.db.MirrorResultAppend(&model.MirrorResult{
+		ProjectID:           proj.ID,
+		Alias:               r.Alias,
+		MirrorAlias:         r.MirrorAlias,
+		Method:              r.Method,
+		Path:                r.Path,
+		Status:              r.Primary.Status,
+		MirrorStatus:        r.Shadow.Status,
+		BodySize:            r.Primary.BodySize,
+		MirrorBodySize:      r.Shadow.BodySize,
+		BodyHash:            r.Primary.BodyHash,
+		MirrorBodyHash:      r.Shadow.BodyHash,
+		LatencyMillis:       int64(r.Primary.Latency / time.Millisecond),
+		MirrorLatencyMillis: int64(r.Shadow.Latency / time.Millisecond),
+		Error:               r.Primary.Error,
+		MirrorError:         r.Shadow.Error,
+		Match:               r.Primary.Error == "" && r.Shadow.Error == "" && r.Primary.Status == r.Shadow.Status && r.Primary.BodyHash == r.Shadow.BodyHash,
+		CreatedAt:           r.Time,
+	})
+}
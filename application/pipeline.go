@@ -0,0 +1,200 @@
+package application
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"warden/deploy"
+	"warden/docker"
+	"warden/store/model"
+)
+
+// Maps the stages reported by the image build to the deployment's states
+var buildStates = map[string]string{
+	docker.StageBuilding: model.DeploymentBuilding,
+	docker.StagePushing:  model.DeploymentPushing,
+}
+
+// Records a new deployment for the instance and queues its image build. The instance
+// is deployed once the image is built. Returns the queued deployment
+func (a *App) startPipeline(proj model.Project, inst model.Instance) (*model.Deployment, error) {
+	dep, err := a.db.DeploymentCreate(inst)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.queuePipeline(proj, inst, *dep); err != nil {
+		a.transition(dep.ID, model.DeploymentFailed, err)
+		return nil, err
+	}
+	return dep, nil
+}
+
+// Queues the builds of deployments that were interrupted by a restart of warden.
+// Deployments whose instance no longer exists are failed
+func (a *App) resumePipelines() {
+	deployments, err := a.db.DeploymentListInStates(model.DeploymentQueued, model.DeploymentBuilding, model.DeploymentPushing)
+	if err != nil {
+		log.Println(errors.Wrap(err, "error resuming interrupted deployments"))
+		return
+	}
+
+	for _, dep := range deployments {
+		inst, err := a.db.InstanceGetById(dep.InstanceID)
+		if err != nil {
+			a.transition(dep.ID, model.DeploymentFailed, errors.Wrap(err, "error getting instance of interrupted deployment"))
+			continue
+		}
+		proj, err := a.db.ProjectGetById(inst.ProjectID)
+		if err != nil {
+			a.transition(dep.ID, model.DeploymentFailed, errors.Wrap(err, "error getting project of interrupted deployment"))
+			continue
+		}
+
+		if dep.State != model.DeploymentQueued {
+			a.transition(dep.ID, model.DeploymentQueued, errors.New("build interrupted by restart, queued again"))
+		}
+		if err := a.queuePipeline(*proj, *inst, dep); err != nil {
+			a.transition(dep.ID, model.DeploymentFailed, err)
+		}
+	}
+}
+
+// Queues the image build of the deployment. Once the image is built, the instance
+// is deployed in the background
+func (a *App) queuePipeline(proj model.Project, inst model.Instance, dep model.Deployment) error {
+	settings := proj.RuntimeSettings.Merge(inst.RuntimeSettings)
+	options := docker.ImageBuildOptions{
+		Name:      proj.Name,
+		GitURL:    proj.GitURL,
+		Hash:      inst.CommitHash,
+		RunEnv:    settings.Runtime,
+		Handler:   settings.Handler,
+		Alias:     inst.Alias,
+		BaseImage: settings.BaseImage,
+		BuildArgs: settings.BuildArgs,
+		OnStage: func(stage string) {
+			a.transition(dep.ID, buildStates[stage], nil)
+		},
+		OnLog: func(entry docker.LogEntry) {
+			if err := a.db.DeploymentLogAppend(&model.DeploymentLog{
+				DeploymentID: dep.ID,
+				Stream:       entry.Stream,
+				Message:      entry.Message,
+				Error:        entry.Error,
+				ErrorCode:    entry.ErrorCode,
+			}); err != nil {
+				log.Println(err)
+			}
+		},
+	}
+
+	return a.dck.QueueBuild(buildId(dep), options, func(hash string, err error) {
+		if err != nil {
+			a.transition(dep.ID, model.DeploymentFailed, errors.Wrap(err, "error building image"))
+			return
+		}
+		// deploy outside of the build worker so that it can take the next build
+		go a.deployPipeline(proj, inst, dep, hash)
+	})
+}
+
+// Deploys the built image of the instance under the instance's alias. The new deployment
+// runs alongside the ones that were running before and the alias is switched to it once
+// it is ready. The previous deployments are then drained of their in-flight requests
+// and stopped. Every stage and any failure is recorded against the deployment.
+func (a *App) deployPipeline(proj model.Project, inst model.Instance, dep model.Deployment, hash string) {
+	// Keep the full commit hash so that later deployments and removals refer to
+	// the same image as this one
+	if hash != inst.CommitHash {
+		if err := a.db.AliasResolveCommit(inst.ID, inst.CommitHash, hash); err != nil {
+			log.Println(err)
+		}
+		inst.CommitHash = hash
+		if _, err := a.db.InstanceUpdate(&inst); err != nil {
+			a.transition(dep.ID, model.DeploymentFailed, errors.Wrap(err, "error saving resolved commit hash"))
+			return
+		}
+	}
+	digest, err := a.dck.ImageDigest(proj.Name, hash)
+	if err != nil {
+		log.Println(err)
+	}
+	if err := a.db.DeploymentSetImage(dep.ID, hash, digest); err != nil {
+		log.Println(err)
+	}
+
+	a.deployLock.Lock()
+	defer a.deployLock.Unlock()
+
+	// Read under the lock so that a pipeline finishing at the same time cannot switch
+	// the alias to a deployment this one does not stop
+	running, err := a.db.DeploymentListByState(inst.ID, model.DeploymentRunning)
+	if err != nil {
+		a.transition(dep.ID, model.DeploymentFailed, err)
+		return
+	}
+
+	a.transition(dep.ID, model.DeploymentDeploying, nil)
+	d := instanceDeployment(proj, inst)
+	d.DeploymentID = dep.ID
+	if d.Env, d.Secrets, err = a.db.EnvVarResolve(proj.ID, inst.Alias); err != nil {
+		a.transition(dep.ID, model.DeploymentFailed, errors.Wrap(err, "error reading environment variables"))
+		return
+	}
+	if err := a.mgr.DeployInstance(d); err != nil {
+		a.transition(dep.ID, model.DeploymentFailed, errors.Wrap(err, "error deploying instance"))
+		return
+	}
+	a.transition(dep.ID, model.DeploymentRunning, nil)
+
+	// The alias now routes to the new deployment. The previous ones finish the requests
+	// they are serving and are removed
+	for _, r := range running {
+		if r.ID == dep.ID {
+			continue
+		}
+		prev := deploy.Deployment{Alias: r.Alias, Project: proj.Name, Hash: r.CommitHash, DeploymentID: r.ID}
+		if err := a.mgr.StopInstance(prev); err != nil {
+			log.Println(errors.Wrapf(err, "error stopping deployment '%d'", r.ID))
+		}
+		a.transition(r.ID, model.DeploymentStopped, errors.Errorf("replaced by deployment '%d'", dep.ID))
+	}
+}
+
+// Moves the deployment to the state. The reason for the move, if any, is recorded
+// with it. Failures to record the state are logged as there is no caller to report
+// them to
+func (a *App) transition(id uint, state string, reason error) {
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+		if state == model.DeploymentFailed {
+			log.Println(reason)
+		}
+	}
+	if _, err := a.db.DeploymentTransition(id, state, msg); err != nil {
+		log.Println(err)
+	}
+}
+
+// Identifies the deployment's image build in the build queue
+func buildId(dep model.Deployment) string {
+	return strconv.Itoa(int(dep.ID))
+}
+
+// Forms the deployment for the project's instance
+func instanceDeployment(proj model.Project, inst model.Instance) deploy.Deployment {
+	return deploy.Deployment{
+		Alias:      inst.Alias,
+		Project:    proj.Name,
+		Hash:       inst.CommitHash,
+		MinReplica: inst.MinReplica,
+		MaxReplica: inst.MaxReplica,
+		InstanceID: inst.ID,
+		Resources:  proj.Resources.Merge(inst.Resources),
+		Split:      inst.TrafficSplit,
+		Mirror:     inst.MirrorAlias,
+	}
+}
@@ -0,0 +1,175 @@
+package application
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"warden/config"
+	"warden/deploy"
+	"warden/docker"
+	"warden/store"
+	"warden/store/model"
+)
+
+const testHash = "95bfc3515452bfafeb2e04f948ac26d1e2a871c8"
+
+// Builds no image. Every image is reported as already built, as when it is found in
+// the registry
+type cachedBuilder struct {
+	m      sync.Mutex
+	builds int
+}
+
+func (b *cachedBuilder) QueueBuild(_ string, options docker.ImageBuildOptions, done func(hash string, err error)) error {
+	b.m.Lock()
+	b.builds++
+	b.m.Unlock()
+	done(options.Hash, nil)
+	return nil
+}
+
+func (b *cachedBuilder) QueuePosition(string) int { return 0 }
+
+func (b *cachedBuilder) ImageDigest(string, string) (string, error) { return "sha256:digest", nil }
+
+// Records the deployments it is asked to deploy and stop
+type fakeManager struct {
+	m        sync.Mutex
+	deployed []deploy.Deployment
+	stopped  []deploy.Deployment
+}
+
+func (f *fakeManager) Close() error { return nil }
+
+func (f *fakeManager) DeployInstance(d deploy.Deployment) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.deployed = append(f.deployed, d)
+	return nil
+}
+
+func (f *fakeManager) Reconcile([]deploy.Deployment) error { return nil }
+
+func (f *fakeManager) RunInstance(*http.Request) (*http.Response, error) { return nil, nil }
+
+func (f *fakeManager) ScaleInstance(deploy.Deployment, int) error { return nil }
+
+func (f *fakeManager) StopInstance(d deploy.Deployment) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.stopped = append(f.stopped, d)
+	return nil
+}
+
+// Creates an app with a project of the name that has a single instance
+func newTestApp(t *testing.T, name string, builder imageBuilder) (*App, *fakeManager, model.Project, model.Instance) {
+	config.ReadConfig()
+	viper.Set("store.dsn", "file:memdb_app?mode=memory&cache=shared")
+	viper.Set("store.dialect", "sqlite3")
+	viper.Set("store.secret_key", "test-secret-key")
+
+	db, err := store.NewStore()
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	user, err := db.UserCreate(store.UserBody{Email: name + "@warden.io", Username: name, Password: "password"})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	proj, err := db.ProjectCreate(
+		"https://github.com/kantopark-tpl/python-simple",
+		name,
+		"A simple description",
+		model.RuntimeSettings{Runtime: "python", Handler: "main.handler"},
+		model.Resources{},
+		*user)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	inst, err := db.InstanceCreate(model.Instance{CommitHash: testHash, Alias: "test"}, proj.Name)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	mgr := &fakeManager{}
+	app := &App{dck: builder, db: db, mgr: mgr, stop: make(chan struct{})}
+	return app, mgr, *proj, *inst
+}
+
+// Waits for the deployment to reach the state
+func waitForState(t *testing.T, app *App, id uint, state string) *model.Deployment {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dep, err := app.db.DeploymentGetById(id)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if dep.State == state || dep.IsFinished() || time.Now().After(deadline) {
+			assert.Equal(t, state, dep.State, dep.Error)
+			return dep
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPipeline_CachedImage(t *testing.T) {
+	app, mgr, proj, inst := newTestApp(t, "cached-image", &cachedBuilder{})
+
+	first, err := app.startPipeline(proj, inst)
+	assert.Nil(t, err)
+	waitForState(t, app, first.ID, model.DeploymentRunning)
+
+	// redeploying the same commit finds the image again and replaces the first deployment
+	second, err := app.startPipeline(proj, inst)
+	assert.Nil(t, err)
+	waitForState(t, app, second.ID, model.DeploymentRunning)
+	waitForState(t, app, first.ID, model.DeploymentStopped)
+
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+	if assert.Len(t, mgr.deployed, 2) {
+		assert.Equal(t, first.ID, mgr.deployed[0].DeploymentID)
+		assert.Equal(t, second.ID, mgr.deployed[1].DeploymentID)
+	}
+	if assert.Len(t, mgr.stopped, 1) {
+		assert.Equal(t, first.ID, mgr.stopped[0].DeploymentID)
+	}
+}
+
+func TestRedeployEnv(t *testing.T) {
+	builder := &cachedBuilder{}
+	app, mgr, proj, inst := newTestApp(t, "redeploy-env", builder)
+
+	first, err := app.startPipeline(proj, inst)
+	assert.Nil(t, err)
+	waitForState(t, app, first.ID, model.DeploymentRunning)
+
+	_, err = app.db.EnvVarSet(proj.Name, "", "API_TOKEN", "token", true)
+	assert.Nil(t, err)
+	updated, err := app.db.ProjectGetById(proj.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, app.redeployEnv(*updated, ""))
+
+	// the running image is deployed again with the variable, without a build
+	second, err := app.db.DeploymentGetLatest(inst.ID)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	waitForState(t, app, second.ID, model.DeploymentRunning)
+	waitForState(t, app, first.ID, model.DeploymentStopped)
+
+	builder.m.Lock()
+	assert.Equal(t, 1, builder.builds)
+	builder.m.Unlock()
+
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+	if assert.Len(t, mgr.deployed, 2) {
+		assert.Equal(t, second.ID, mgr.deployed[1].DeploymentID)
+		assert.Equal(t, "token", mgr.deployed[1].Env["API_TOKEN"])
+	}
+}
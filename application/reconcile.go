@@ -0,0 +1,88 @@
+package application
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"warden/deploy"
+	"warden/store/model"
+)
+
+// Reconciles the deployment manager on startup and then at every interval
+// (deploy.reconcile_interval) until the app is closed. Deployments that were being
+// deployed when warden went down are failed first as nothing will finish them
+func (a *App) startReconciler() {
+	deploying, err := a.db.DeploymentListInStates(model.DeploymentDeploying)
+	if err != nil {
+		log.Println(errors.Wrap(err, "error getting interrupted deployments"))
+	}
+	for _, dep := range deploying {
+		a.transition(dep.ID, model.DeploymentFailed, errors.New("deploy interrupted by restart"))
+	}
+
+	if err := a.reconcile(); err != nil {
+		log.Println(errors.Wrap(err, "error reconciling deployments on startup"))
+	}
+
+	interval := viper.GetDuration("deploy.reconcile_interval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				if err := a.reconcile(); err != nil {
+					log.Println(errors.Wrap(err, "error reconciling deployments"))
+				}
+			}
+		}
+	}()
+}
+
+// Brings the deployment manager in line with the deployments recorded as running in
+// the store. Runs while no deployment is in progress so that a deployment that is
+// being replaced isn't mistaken for a stray
+func (a *App) reconcile() error {
+	a.deployLock.Lock()
+	defer a.deployLock.Unlock()
+
+	running, err := a.db.DeploymentListInStates(model.DeploymentRunning)
+	if err != nil {
+		return err
+	}
+
+	var desired []deploy.Deployment
+	for _, dep := range running {
+		inst, err := a.db.InstanceGetById(dep.InstanceID)
+		if err == gorm.ErrRecordNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		proj, err := a.db.ProjectGetById(inst.ProjectID)
+		if err == gorm.ErrRecordNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		d := instanceDeployment(*proj, *inst)
+		d.Alias, d.Hash, d.DeploymentID = dep.Alias, dep.CommitHash, dep.ID
+		// a deployment left out of the desired ones would be stopped
+		if d.Env, d.Secrets, err = a.db.EnvVarResolve(proj.ID, d.Alias); err != nil {
+			return err
+		}
+		desired = append(desired, d)
+	}
+	return a.mgr.Reconcile(desired)
+}
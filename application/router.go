@@ -28,6 +28,13 @@ func (a *App) Router() *chi.Mux {
 			r.Post("/", a.CreateProject)
 			r.Put("/", a.UpdateProject)
 			r.Delete("/{name}", a.DeleteProject)
+			r.Put("/{name}/env", a.SetProjectEnv)
+			r.Delete("/{name}/env/{var}", a.DeleteProjectEnv)
+			r.Get("/{name}/alias/{alias}/history", a.GetAliasHistory)
+			r.Post("/{name}/alias/{alias}/rollback", a.RollbackAlias)
+			r.Get("/{name}/alias/{alias}/mirror", a.GetMirrorResults)
+			r.Get("/{name}/instances/{id}/status", a.GetInstanceStatus)
+			r.Get("/{name}/instances/{id}/logs", a.GetInstanceLogs)
 		})
 
 		r.Route("/project-instance", func(r chi.Router) {
@@ -50,12 +57,12 @@ func (a *App) Router() *chi.Mux {
 			r.Post("/login", a.Login)
 			r.Post("/signup", a.Signup)
 		})
-		// Execute instance
+		// Execute instance. Any method is forwarded, the instance decides which it serves.
+		// The path after the alias is forwarded as well
 		r.Route("/e", func(r chi.Router) {
-			r.Get("/{project}", a.ExecuteInstance)
-			r.Get("/{project}/{alias}", a.ExecuteInstance)
-			r.Post("/{project}", a.ExecuteInstance)
-			r.Post("/{project}/{alias}", a.ExecuteInstance)
+			r.HandleFunc("/{project}", a.ExecuteInstance)
+			r.HandleFunc("/{project}/{alias}", a.ExecuteInstance)
+			r.HandleFunc("/{project}/{alias}/*", a.ExecuteInstance)
 		})
 	})
 
@@ -0,0 +1,129 @@
+package application
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"warden/store/model"
+	"warden/utils"
+)
+
+type rollbackBody struct {
+	ID uint `json:"id"` // assignment to restore. Leave empty to restore the previous commit
+}
+
+// Get request. Lists the commits the alias was pointed to, who pointed it there and
+// when, most recent first
+func (a *App) GetAliasHistory(w http.ResponseWriter, r *http.Request) {
+	proj, owned := a.ownedProject(w, r)
+	if !owned {
+		return
+	}
+
+	history, err := a.db.AliasHistory(proj.ID, chi.URLParam(r, "alias"))
+	if err != nil {
+		internalServerError(w, err)
+		return
+	}
+	jsonify(w, history)
+}
+
+// Get request. Lists the results of the requests mirrored from the alias to its shadow
+// alias, most recent first. The "limit" query parameter sets the number of results,
+// 100 by default
+func (a *App) GetMirrorResults(w http.ResponseWriter, r *http.Request) {
+	proj, owned := a.ownedProject(w, r)
+	if !owned {
+		return
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			badRequest(w, errors.New("limit must be a positive integer"))
+			return
+		}
+	}
+
+	results, err := a.db.MirrorResultList(proj.ID, chi.URLParam(r, "alias"), limit)
+	if err != nil {
+		internalServerError(w, err)
+		return
+	}
+	jsonify(w, results)
+}
+
+// Post request. Points the alias back to the commit it was assigned before, or to the
+// commit of the assignment given in the payload. The restored commit is rebuilt and
+// redeployed in the background like any other update of the instance
+func (a *App) RollbackAlias(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	proj, owned := a.ownedProject(w, r)
+	if !owned {
+		return
+	}
+
+	// the payload is optional
+	var body rollbackBody
+	if err := parseJson(r.Body, &body); err != nil && errors.Cause(err) != io.EOF {
+		badRequest(w, errors.Wrap(err, "error parsing JSON"))
+		return
+	}
+
+	inst, found := aliasInstance(*proj, chi.URLParam(r, "alias"))
+	if !found {
+		notFound(w, errors.Errorf("could not find alias '%s' of project '%s'", chi.URLParam(r, "alias"), proj.Name))
+		return
+	}
+
+	target, err := a.db.AliasRollbackTarget(proj.ID, inst.Alias, inst.CommitHash, body.ID)
+	if err == gorm.ErrRecordNotFound {
+		notFound(w, errors.Errorf("could not find an earlier commit of alias '%s' to roll back to", inst.Alias))
+		return
+	} else if err != nil {
+		internalServerError(w, err)
+		return
+	}
+	if target.CommitHash == inst.CommitHash {
+		badRequest(w, errors.Errorf("alias '%s' already points to commit '%s'", inst.Alias, inst.CommitHash))
+		return
+	}
+	// an alias cannot point to a commit that its split also sends requests to
+	if inst.Split.Contains(target.CommitHash) {
+		conflict(w, errors.Errorf("commit '%s' is part of the traffic split of alias '%s'. Remove it from the split before rolling back to it", target.CommitHash, inst.Alias))
+		return
+	}
+
+	inst.CommitHash = target.CommitHash
+	updated, err := a.db.InstanceUpdate(&inst)
+	if err != nil {
+		internalServerError(w, errors.Wrap(err, "could not update instance"))
+		return
+	}
+	if _, err := a.db.AliasAssign(*updated, u.Username, target.ID); err != nil {
+		internalServerError(w, err)
+		return
+	}
+	if _, err := a.startPipeline(*proj, *updated); err != nil {
+		internalServerError(w, errors.Wrap(err, "error starting deployment of instance"))
+		return
+	}
+	jsonify(w, updated)
+}
+
+// Gets the project's instance that the alias points to
+func aliasInstance(proj model.Project, alias string) (model.Instance, bool) {
+	alias = utils.StrLowerTrim(alias)
+	for _, inst := range proj.Instances {
+		if inst.Alias == alias {
+			return inst, true
+		}
+	}
+	return model.Instance{}, false
+}
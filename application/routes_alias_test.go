@@ -0,0 +1,47 @@
+package application
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
+)
+
+func TestRollbackAlias_TargetInSplit(t *testing.T) {
+	app, mgr, proj, inst := newTestApp(t, "rollback-split", &cachedBuilder{})
+	_, err := app.db.AliasAssign(inst, "rollback-split", 0)
+	assert.Nil(t, err)
+
+	// the alias moved on to another commit and sends a share of its requests back
+	inst.CommitHash = "1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e"
+	inst.Split = model.Split{{CommitHash: testHash[:7], Weight: 10}}
+	updated, err := app.db.InstanceUpdate(&inst)
+	assert.Nil(t, err)
+	_, err = app.db.AliasAssign(*updated, "rollback-split", 0)
+	assert.Nil(t, err)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", proj.Name)
+	rctx.URLParams.Add("alias", inst.Alias)
+	ctx := context.WithValue(context.Background(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, userContextKey, userCtx{Username: "rollback-split"})
+	r := httptest.NewRequest("POST", "/", strings.NewReader("")).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	app.RollbackAlias(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "is part of the traffic split of alias 'test'")
+
+	current, err := app.db.InstanceGetById(inst.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, inst.CommitHash, current.CommitHash)
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+	assert.Empty(t, mgr.deployed)
+}
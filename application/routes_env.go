@@ -0,0 +1,98 @@
+package application
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"warden/store/model"
+	"warden/utils"
+)
+
+type envBody struct {
+	Alias  string `json:"alias"` // leave empty to set the variable for every alias
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret"`
+}
+
+// Put request. Sets an environment variable of the project. The running instances of
+// the aliases the variable applies to are redeployed in the background to pick it up.
+// The value of secrets is not returned
+func (a *App) SetProjectEnv(w http.ResponseWriter, r *http.Request) {
+	proj, owned := a.ownedProject(w, r)
+	if !owned {
+		return
+	}
+
+	var e envBody
+	if err := parseJson(r.Body, &e); err != nil {
+		internalServerError(w, errors.Wrap(err, "error parsing JSON"))
+		return
+	}
+
+	env, err := a.db.EnvVarSet(proj.Name, e.Alias, e.Name, e.Value, e.Secret)
+	if err != nil {
+		badRequest(w, errors.Wrap(err, "error setting environment variable"))
+		return
+	}
+	if err := a.redeployEnv(*proj, env.Alias); err != nil {
+		internalServerError(w, err)
+		return
+	}
+	jsonify(w, env)
+}
+
+// Delete request. Removes an environment variable of the project. The variable set for
+// every alias is removed unless the "alias" query parameter is given. The running
+// instances of the aliases the variable applied to are redeployed in the background
+func (a *App) DeleteProjectEnv(w http.ResponseWriter, r *http.Request) {
+	proj, owned := a.ownedProject(w, r)
+	if !owned {
+		return
+	}
+
+	alias := utils.StrLowerTrim(r.URL.Query().Get("alias"))
+	name := chi.URLParam(r, "var")
+	if err := a.db.EnvVarDelete(proj.Name, alias, name); err == gorm.ErrRecordNotFound {
+		notFound(w, errors.Errorf("could not find environment variable '%s'", name))
+		return
+	} else if err != nil {
+		internalServerError(w, errors.Wrap(err, "error removing environment variable"))
+		return
+	}
+	if err := a.redeployEnv(*proj, alias); err != nil {
+		internalServerError(w, err)
+		return
+	}
+	ok(w)
+}
+
+// Redeploys the running instances of the project's alias so that they pick up its
+// changed environment variables. An empty alias redeploys the instances of every alias.
+// The running image is deployed again in the background without being rebuilt
+func (a *App) redeployEnv(proj model.Project, alias string) error {
+	for _, inst := range proj.Instances {
+		if alias != "" && inst.Alias != alias {
+			continue
+		}
+		running, err := a.db.DeploymentListByState(inst.ID, model.DeploymentRunning)
+		if err != nil {
+			return err
+		}
+		// a deployment of another commit is on its way and reads the variables when
+		// it is deployed
+		if len(running) == 0 || running[len(running)-1].CommitHash != inst.CommitHash {
+			continue
+		}
+
+		dep, err := a.db.DeploymentCreate(inst)
+		if err != nil {
+			return errors.Wrapf(err, "error redeploying alias '%s'", inst.Alias)
+		}
+		go a.deployPipeline(proj, inst, *dep, inst.CommitHash)
+	}
+	return nil
+}
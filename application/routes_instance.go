@@ -1,17 +1,23 @@
 package application
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 
 	"warden/store/model"
 	"warden/utils"
 )
 
-// Post request. Appends a new Instances to Project.
+// Post request. Appends a new Instances to Project. The instance's commit is built and
+// deployed in the background, its progress is reported by the instance's status
 func (a *App) CreateProjectInstance(w http.ResponseWriter, r *http.Request) {
 	u := currentUser(r)
 
@@ -30,10 +36,23 @@ func (a *App) CreateProjectInstance(w http.ResponseWriter, r *http.Request) {
 		forbidden(w, errors.New("you're not authorized to make changes to this project"))
 		return
 	}
+	if err := checkSplit(*proj, i); err != nil {
+		badRequest(w, err)
+		return
+	}
 
-	inst, err := a.db.InstanceCreate(i.CommitHash, i.Alias, proj.Name)
+	inst, err := a.db.InstanceCreate(i, proj.Name)
 	if err != nil {
 		internalServerError(w, errors.Wrap(err, "error creating instance"))
+		return
+	}
+	if _, err := a.db.AliasAssign(*inst, u.Username, 0); err != nil {
+		internalServerError(w, err)
+		return
+	}
+	if _, err := a.startPipeline(*proj, *inst); err != nil {
+		internalServerError(w, errors.Wrap(err, "error starting deployment of instance"))
+		return
 	}
 	jsonify(w, inst)
 }
@@ -62,8 +81,16 @@ func (a *App) DeleteProjectInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the instances must be removed from the store before they are reconciled again
+	a.deployLock.Lock()
+	defer a.deployLock.Unlock()
+
 	for _, i := range proj.Instances {
 		if i.ID == uint(id) {
+			if err := a.mgr.StopInstance(instanceDeployment(*proj, i)); err != nil {
+				internalServerError(w, errors.Wrap(err, "error stopping instance"))
+				return
+			}
 			if err := a.db.InstanceDelete(i.ProjectID, i.CommitHash); err != nil {
 				internalServerError(w, errors.Wrap(err, "error removing instance"))
 				return
@@ -78,7 +105,9 @@ func (a *App) DeleteProjectInstance(w http.ResponseWriter, r *http.Request) {
 }
 
 // Put request. Updates a Instances associated with the project with
-// the JSON payload
+// the JSON payload. The updated instance is rebuilt and redeployed in the background
+// and replaces the previous deployments once it is running. A change of the commit or
+// alias is recorded in the alias' history
 func (a *App) UpdateProjectInstance(w http.ResponseWriter, r *http.Request) {
 	u := currentUser(r)
 
@@ -101,6 +130,10 @@ func (a *App) UpdateProjectInstance(w http.ResponseWriter, r *http.Request) {
 		forbidden(w, errors.New("you're not authorized to make changes to this project"))
 		return
 	}
+	if err := checkSplit(*proj, i); err != nil {
+		badRequest(w, err)
+		return
+	}
 
 	for _, inst := range proj.Instances {
 		if inst.ID == i.ID {
@@ -109,9 +142,182 @@ func (a *App) UpdateProjectInstance(w http.ResponseWriter, r *http.Request) {
 				internalServerError(w, errors.Wrap(err, "could not update instance"))
 				return
 			}
+			if inst.CommitHash != updated_inst.CommitHash || inst.Alias != updated_inst.Alias {
+				if _, err := a.db.AliasAssign(*updated_inst, u.Username, 0); err != nil {
+					internalServerError(w, err)
+					return
+				}
+			}
+			if _, err := a.startPipeline(*proj, *updated_inst); err != nil {
+				internalServerError(w, errors.Wrap(err, "error starting deployment of instance"))
+				return
+			}
 			jsonify(w, updated_inst)
 			return
 		}
 	}
 	badRequest(w, errors.Errorf("could not find instance with project id '%d' and instance id '%d'", i.ProjectID, i.ID))
 }
+
+// Get request. Reads the status of the most recent deployment of the instance, including
+// every state it went through and the error that failed it, if any. While the build is
+// waiting for a worker, the status includes its position in the build queue
+func (a *App) GetInstanceStatus(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.ownedInstance(w, r)
+	if !ok {
+		return
+	}
+
+	dep, err := a.db.DeploymentGetLatest(inst.ID)
+	if err == gorm.ErrRecordNotFound {
+		notFound(w, errors.Errorf("instance '%d' has not been deployed", inst.ID))
+		return
+	} else if err != nil {
+		internalServerError(w, err)
+		return
+	}
+	jsonify(w, struct {
+		*model.Deployment
+		QueuePosition int `json:"queue_position,omitempty"`
+	}{dep, a.dck.QueuePosition(buildId(*dep))})
+}
+
+// Get request. Reads the image build and push logs of the instance's most recent
+// deployment, or of the deployment given by the "deployment" query parameter. With
+// "follow=true", the response is kept open and new lines are sent as they are written
+// until the build completes. Clients that accept "text/event-stream" receive the logs
+// as server-sent events, otherwise each line is sent as plain text
+func (a *App) GetInstanceLogs(w http.ResponseWriter, r *http.Request) {
+	inst, ok := a.ownedInstance(w, r)
+	if !ok {
+		return
+	}
+
+	var dep *model.Deployment
+	var err error
+	if depId := r.URL.Query().Get("deployment"); depId != "" {
+		id, perr := strconv.Atoi(depId)
+		if perr != nil {
+			badRequest(w, errors.New("unable to parse deployment field as an integer"))
+			return
+		}
+		dep, err = a.db.DeploymentGetById(uint(id))
+		if err == nil && dep.InstanceID != inst.ID {
+			err = gorm.ErrRecordNotFound
+		}
+	} else {
+		dep, err = a.db.DeploymentGetLatest(inst.ID)
+	}
+	if err == gorm.ErrRecordNotFound {
+		notFound(w, errors.Errorf("could not find deployment of instance '%d'", inst.ID))
+		return
+	} else if err != nil {
+		internalServerError(w, err)
+		return
+	}
+
+	follow := utils.StrIn(r.URL.Query().Get("follow"), nil, "true", "1")
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, canFlush := w.(http.Flusher)
+
+	var last uint
+	for {
+		// The state is read before the logs so that lines written just before the
+		// build completes are not missed
+		if dep, err = a.db.DeploymentGetById(dep.ID); err != nil {
+			return
+		}
+		building := utils.StrIn(dep.State, nil, model.DeploymentQueued, model.DeploymentBuilding, model.DeploymentPushing)
+
+		logs, err := a.db.DeploymentLogList(dep.ID, last)
+		if err != nil {
+			return
+		}
+		for _, l := range logs {
+			if sse {
+				data, _ := json.Marshal(l)
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", l.ID, data)
+			} else if l.Error != "" {
+				fmt.Fprintf(w, "[%s] error: %s\n", l.Stream, l.Error)
+			} else {
+				fmt.Fprintf(w, "[%s] %s\n", l.Stream, l.Message)
+			}
+			last = l.ID
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+
+		if !follow || !building {
+			if sse {
+				fmt.Fprintf(w, "event: end\ndata: %s\n\n", dep.State)
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// Checks that every commit in the instance's traffic split is served by another
+// instance of the project, as the split only sends requests to running commits
+func checkSplit(proj model.Project, inst model.Instance) error {
+	for _, t := range inst.Split {
+		served := false
+		for _, other := range proj.Instances {
+			if other.ID != inst.ID && strings.HasPrefix(other.CommitHash, strings.TrimSpace(t.CommitHash)) {
+				served = true
+				break
+			}
+		}
+		if !served {
+			return errors.Errorf("commit '%s' of the traffic split must be deployed by another instance of project '%s'", t.CommitHash, proj.Name)
+		}
+	}
+	return nil
+}
+
+// Gets the instance specified by the project name and instance id in the url. If the
+// instance cannot be found or the user does not own the project, the error is written
+// to the response and false is returned
+func (a *App) ownedInstance(w http.ResponseWriter, r *http.Request) (*model.Instance, bool) {
+	u := currentUser(r)
+	projectName := chi.URLParam(r, "name")
+	id, err := strconv.Atoi(utils.StrLowerTrim(chi.URLParam(r, "id")))
+	if err != nil {
+		badRequest(w, errors.New("unable to parse id field as an integer"))
+		return nil, false
+	}
+
+	proj, err := a.db.ProjectGetByName(projectName)
+	if err == gorm.ErrRecordNotFound {
+		notFound(w, errors.Errorf("could not find project with name '%s'", projectName))
+		return nil, false
+	} else if err != nil {
+		internalServerError(w, errors.Wrapf(err, "error getting project with name = %s", projectName))
+		return nil, false
+	}
+	if !proj.HasOwner(u.Username) {
+		forbidden(w, errors.New("you're not authorized to view this project"))
+		return nil, false
+	}
+
+	for _, i := range proj.Instances {
+		if i.ID == uint(id) {
+			return &i, true
+		}
+	}
+	notFound(w, errors.Errorf("could not find instance with project name '%s' and id '%d'", projectName, id))
+	return nil, false
+}
@@ -4,13 +4,18 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
+
+	"warden/store/model"
 )
 
 type projectBody struct {
 	Description string `json:"description"`
 	GitURL      string `json:"git_url"`
 	Name        string `json:"name"`
+	model.RuntimeSettings
+	model.Resources
 }
 
 // Post request. Creates a new project in the system. JSON payload
@@ -30,14 +35,16 @@ func (a *App) CreateProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	project, err := a.db.ProjectCreate(p.GitURL, p.Name, p.Description, *user)
+	project, err := a.db.ProjectCreate(p.GitURL, p.Name, p.Description, p.RuntimeSettings, p.Resources, *user)
 	if err != nil {
 		internalServerError(w, errors.Wrap(err, "error creating project"))
+		return
 	}
 	jsonify(w, project)
 }
 
-// Delete request. Removes project and all Instances associated with it
+// Delete request. Removes project and all Instances associated with it. The instances'
+// deployments are stopped as well
 func (a *App) DeleteProject(w http.ResponseWriter, r *http.Request) {
 	u := currentUser(r)
 	proj, err := a.db.ProjectGetByName(chi.URLParam(r, "name"))
@@ -51,6 +58,17 @@ func (a *App) DeleteProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the instances must be removed from the store before they are reconciled again
+	a.deployLock.Lock()
+	defer a.deployLock.Unlock()
+
+	for _, i := range proj.Instances {
+		if err := a.mgr.StopInstance(instanceDeployment(*proj, i)); err != nil {
+			internalServerError(w, errors.Wrapf(err, "error stopping instance '%s'", i.Alias))
+			return
+		}
+	}
+
 	if err := a.db.ProjectDelete(proj.Name); err != nil {
 		internalServerError(w, errors.Wrap(err, "error deleting project"))
 		return
@@ -109,6 +127,8 @@ func (a *App) UpdateProject(w http.ResponseWriter, r *http.Request) {
 	proj.GitURL = p.GitURL
 	proj.Description = p.Description
 	proj.Name = p.Name
+	proj.RuntimeSettings = p.RuntimeSettings
+	proj.Resources = p.Resources
 	if err := proj.Validate(); err != nil {
 		badRequest(w, errors.Wrap(err, "invalid update parameters for project"))
 		return
@@ -122,3 +142,24 @@ func (a *App) UpdateProject(w http.ResponseWriter, r *http.Request) {
 
 	jsonify(w, proj)
 }
+
+// Gets the project named in the URL if the current user owns it. Otherwise, the error
+// response is written and false is returned
+func (a *App) ownedProject(w http.ResponseWriter, r *http.Request) (*model.Project, bool) {
+	u := currentUser(r)
+	name := chi.URLParam(r, "name")
+
+	proj, err := a.db.ProjectGetByName(name)
+	if err == gorm.ErrRecordNotFound {
+		notFound(w, errors.Errorf("could not find project with name '%s'", name))
+		return nil, false
+	} else if err != nil {
+		internalServerError(w, errors.Wrapf(err, "error getting project with name = %s", name))
+		return nil, false
+	}
+	if !proj.HasOwner(u.Username) {
+		forbidden(w, errors.New("you're not authorized to make changes to this project"))
+		return nil, false
+	}
+	return proj, true
+}
@@ -42,10 +42,25 @@ func badRequest(w http.ResponseWriter, err error) {
 	errorResponse(w, err, http.StatusBadRequest)
 }
 
+// Returns a Bad Gateway response
+func badGateway(w http.ResponseWriter, err error) {
+	errorResponse(w, err, http.StatusBadGateway)
+}
+
+// Returns a Conflict response
+func conflict(w http.ResponseWriter, err error) {
+	errorResponse(w, err, http.StatusConflict)
+}
+
 func forbidden(w http.ResponseWriter, err error) {
 	errorResponse(w, err, http.StatusForbidden)
 }
 
+// Returns a Gateway Timeout response
+func gatewayTimeout(w http.ResponseWriter, err error) {
+	errorResponse(w, err, http.StatusGatewayTimeout)
+}
+
 // Returns interface object as json.
 func jsonify(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -54,6 +69,16 @@ func jsonify(w http.ResponseWriter, v interface{}) {
 	}
 }
 
+// Returns a Method Not Allowed response
+func methodNotAllowed(w http.ResponseWriter, err error) {
+	errorResponse(w, err, http.StatusMethodNotAllowed)
+}
+
+// Returns a Not Found response
+func notFound(w http.ResponseWriter, err error) {
+	errorResponse(w, err, http.StatusNotFound)
+}
+
 // Returns a Status Okay response
 func ok(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
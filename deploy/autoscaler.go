@@ -0,0 +1,437 @@
+package deploy
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Response header reporting how long the request was held while its instance was
+// started from zero replicas
+const ColdStartHeader = "X-Warden-Cold-Start"
+
+// Settings of the autoscaler
+type autoscaleConfig struct {
+	enabled           bool          // scale on the observed load. Idle instances are stopped regardless
+	idleTimeout       time.Duration // time without requests before an instance with MinReplica 0 is stopped. 0 disables
+	interval          time.Duration // time between each scaling decision
+	targetConcurrency float64       // in-flight requests each replica should handle
+	targetLatency     time.Duration // average latency above which a replica is added. 0 disables
+	scaleUpCooldown   time.Duration // minimum time after scaling before scaling up
+	scaleDownCooldown time.Duration // minimum time after scaling before scaling down
+}
+
+// The load observed on a deployment since the last scaling decision
+type scaledDeployment struct {
+	deployment  Deployment
+	replicas    int
+	inFlight    int
+	load        float64       // in-flight requests integrated over time, in request-seconds
+	latency     time.Duration // total latency of the requests completed
+	completed   int
+	windowStart time.Time // start of the observation window
+	lastChange  time.Time // last time inFlight changed
+	lastScaled  time.Time
+	lastRequest time.Time
+	starting    *coldStart // set while the deployment is started from zero replicas
+	scaling     sync.Mutex // serializes the scaling of the deployment
+}
+
+// A start of a deployment from zero replicas that requests wait on
+type coldStart struct {
+	done chan struct{}
+	err  error
+}
+
+// Adds the in-flight requests since the last change to the load
+func (s *scaledDeployment) accumulate(now time.Time) {
+	s.load += float64(s.inFlight) * now.Sub(s.lastChange).Seconds()
+	s.lastChange = now
+}
+
+// A scaling decision to be applied to a deployment
+type scaleAction struct {
+	addr       string
+	deployment Deployment
+	replicas   int
+}
+
+// Scales the instances of any Manager between their MinReplica and MaxReplica. The
+// autoscaler wraps the Manager and observes the in-flight requests and latency of
+// each address as requests go through RunInstance. At every interval, the number of
+// replicas is set so that each replica handles the target concurrency, with an
+// extra replica added while the average latency is above the target.
+//
+// Instances with a MinReplica of 0 are scaled to zero once idle. The next request
+// is held while a replica is started and reports the wait in the ColdStartHeader
+type autoscaler struct {
+	mgr         Manager
+	config      autoscaleConfig
+	m           sync.Mutex
+	deployments map[string]*scaledDeployment // keyed by address
+	now         func() time.Time
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Deploys the instance and starts observing its address
+func (a *autoscaler) DeployInstance(d Deployment) error {
+	if err := a.mgr.DeployInstance(d); err != nil {
+		return err
+	}
+	_ = d.validate()
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.track(d)
+	return nil
+}
+
+// Reconciles the underlying Manager, then observes the desired deployments. The
+// deployments that are already observed keep their load
+func (a *autoscaler) Reconcile(desired []Deployment) error {
+	err := a.mgr.Reconcile(desired)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	want := make(map[string]bool)
+	for _, d := range desired {
+		_ = d.validate()
+		want[d.Address()] = true
+		if s, ok := a.deployments[d.Address()]; !ok || !s.deployment.sameAs(d) {
+			a.track(d)
+		}
+	}
+	for addr := range a.deployments {
+		if !want[addr] {
+			delete(a.deployments, addr)
+		}
+	}
+	return err
+}
+
+// Starts observing the deployment, replacing the previous deployment of its address.
+// Must be called with the lock held
+func (a *autoscaler) track(d Deployment) {
+	now := a.now()
+	s := &scaledDeployment{
+		deployment:  d,
+		replicas:    d.MinReplica,
+		windowStart: now,
+		lastChange:  now,
+		lastScaled:  now,
+		lastRequest: now,
+	}
+	// requests to the previous deployment of the address are still in flight
+	if prev, ok := a.deployments[d.Address()]; ok {
+		s.inFlight = prev.inFlight
+	}
+	a.deployments[d.Address()] = s
+}
+
+// Stops the instance. The address is no longer observed unless it has since been
+// deployed with another commit
+func (a *autoscaler) StopInstance(d Deployment) error {
+	if err := a.mgr.StopInstance(d); err != nil {
+		return err
+	}
+	_ = d.validate()
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if s, ok := a.deployments[d.Address()]; ok && s.deployment.sameAs(d) {
+		delete(a.deployments, d.Address())
+	}
+	return nil
+}
+
+// Runs the instance, recording the request's time in flight and latency. Latency is
+// measured until the instance's response headers are received, while the request is
+// in flight until its response body is closed. If the instance has been scaled to
+// zero, it is started before the request is forwarded
+func (a *autoscaler) RunInstance(r *http.Request) (*http.Response, error) {
+	payload, err := NewPayload(r)
+	if err != nil {
+		return a.mgr.RunInstance(r)
+	}
+
+	addr := payload.Address()
+	start := a.begin(addr)
+
+	started, err := a.coldStart(r.Context(), addr)
+	if err != nil {
+		a.end(addr)
+		return nil, err
+	}
+	wait := a.now().Sub(start)
+
+	resp, err := a.mgr.RunInstance(r)
+	a.measure(addr, start)
+	if err != nil {
+		a.end(addr)
+		return nil, err
+	}
+	if started {
+		resp.Header.Set(ColdStartHeader, wait.String())
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { a.end(addr) }}
+	return resp, nil
+}
+
+// Scales the instance and records the new number of replicas. Scaling to zero is
+// dropped if the deployment received requests since it was found idle, as a cold
+// start may already have started it again
+func (a *autoscaler) ScaleInstance(d Deployment, replicas int) error {
+	_ = d.validate()
+	s := a.lookup(d)
+	if s != nil {
+		s.scaling.Lock()
+		defer s.scaling.Unlock()
+
+		if replicas == 0 && !a.stillIdle(s) {
+			return nil
+		}
+	}
+
+	if err := a.mgr.ScaleInstance(d, replicas); err != nil {
+		return err
+	}
+
+	if s != nil {
+		a.m.Lock()
+		s.replicas = replicas
+		s.lastScaled = a.now()
+		a.m.Unlock()
+	}
+	return nil
+}
+
+// Checks that the deployment has no requests in flight or waiting on a start and has
+// not received any within the idle timeout
+func (a *autoscaler) stillIdle(s *scaledDeployment) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.idle(s, a.now())
+}
+
+// Must be called with the lock held
+func (a *autoscaler) idle(s *scaledDeployment, now time.Time) bool {
+	return a.config.idleTimeout > 0 && s.inFlight == 0 && s.starting == nil && now.Sub(s.lastRequest) >= a.config.idleTimeout
+}
+
+// Gets the observed deployment if it is still the one serving its address
+func (a *autoscaler) lookup(d Deployment) *scaledDeployment {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if s, ok := a.deployments[d.Address()]; ok && s.deployment.sameAs(d) {
+		return s
+	}
+	return nil
+}
+
+// Starts a replica of the address' deployment if it has been scaled to zero and waits
+// for it to be ready. Concurrent requests wait on the same start. Returns true if the
+// request had to wait
+func (a *autoscaler) coldStart(ctx context.Context, addr string) (bool, error) {
+	a.m.Lock()
+	s, ok := a.deployments[addr]
+	if !ok || (s.replicas > 0 && s.starting == nil) {
+		a.m.Unlock()
+		return false, nil
+	}
+	if s.starting == nil {
+		s.starting = &coldStart{done: make(chan struct{})}
+		go a.startReplica(s, s.starting)
+	}
+	cs := s.starting
+	a.m.Unlock()
+
+	select {
+	case <-cs.done:
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return true, errors.Wrapf(ErrRequestCancelled, "request to '%s' cancelled while instance was starting", addr)
+		}
+		return true, errors.Wrapf(ErrInstanceTimeout, "instance at '%s' did not start in time", addr)
+	}
+	if cs.err != nil {
+		return true, errors.Wrapf(ErrInstanceUnreachable, "instance at '%s' could not be started: %s", addr, cs.err)
+	}
+	return true, nil
+}
+
+func (a *autoscaler) startReplica(s *scaledDeployment, cs *coldStart) {
+	cs.err = a.ScaleInstance(s.deployment, 1)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	s.starting = nil
+	close(cs.done)
+}
+
+// Stops the autoscaler, then closes the underlying Manager
+func (a *autoscaler) Close() error {
+	close(a.stop)
+	<-a.done
+	return a.mgr.Close()
+}
+
+func (a *autoscaler) begin(addr string) time.Time {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	now := a.now()
+	if s, ok := a.deployments[addr]; ok {
+		s.accumulate(now)
+		s.inFlight++
+		s.lastRequest = now
+	}
+	return now
+}
+
+// Records the latency of a request to the address once the instance responded
+func (a *autoscaler) measure(addr string, start time.Time) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if s, ok := a.deployments[addr]; ok {
+		s.latency += a.now().Sub(start)
+		s.completed++
+	}
+}
+
+// Records that a request to the address is no longer in flight
+func (a *autoscaler) end(addr string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	now := a.now()
+	if s, ok := a.deployments[addr]; ok {
+		s.accumulate(now)
+		// the address may have been redeployed while the request was in flight
+		if s.inFlight > 0 {
+			s.inFlight--
+		}
+		s.lastRequest = now
+	}
+}
+
+func (a *autoscaler) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.scale()
+		}
+	}
+}
+
+// Applies the scaling decisions. Scaling is done outside the lock as starting
+// replicas can take a while
+func (a *autoscaler) scale() {
+	for _, action := range a.evaluate() {
+		if err := a.ScaleInstance(action.deployment, action.replicas); err != nil {
+			log.Println(errors.Wrapf(err, "could not scale '%s' to %d replicas", action.addr, action.replicas))
+		}
+	}
+}
+
+// Computes the number of replicas each address needs from the load observed since
+// the last evaluation and starts a new observation window. Idle deployments with a
+// MinReplica of 0 are marked as scaled to zero right away so that new requests wait
+// for them to start again
+func (a *autoscaler) evaluate() []scaleAction {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	now := a.now()
+	var actions []scaleAction
+	for addr, s := range a.deployments {
+		s.accumulate(now)
+		window := now.Sub(s.windowStart).Seconds()
+		load, latency, completed := s.load, s.latency, s.completed
+		s.load, s.latency, s.completed, s.windowStart = 0, 0, 0, now
+		if window <= 0 || s.replicas == 0 || s.starting != nil {
+			continue
+		}
+
+		d := s.deployment
+		if d.MinReplica == 0 && a.idle(s, now) {
+			s.replicas = 0
+			actions = append(actions, scaleAction{addr, d, 0})
+			continue
+		}
+		if !a.config.enabled {
+			continue
+		}
+
+		desired := int(math.Ceil(load / window / a.config.targetConcurrency))
+		if a.config.targetLatency > 0 && completed > 0 && latency/time.Duration(completed) > a.config.targetLatency && desired <= s.replicas {
+			desired = s.replicas + 1
+		}
+		// only idleness scales to zero
+		if desired < d.MinReplica {
+			desired = d.MinReplica
+		}
+		if desired < 1 {
+			desired = 1
+		}
+		if desired > d.MaxReplica {
+			desired = d.MaxReplica
+		}
+
+		sinceScaled := now.Sub(s.lastScaled)
+		if (desired > s.replicas && sinceScaled >= a.config.scaleUpCooldown) ||
+			(desired < s.replicas && sinceScaled >= a.config.scaleDownCooldown) {
+			actions = append(actions, scaleAction{addr, d, desired})
+		}
+	}
+	return actions
+}
+
+func newAutoscaler(mgr Manager, config autoscaleConfig) *autoscaler {
+	return &autoscaler{
+		mgr:         mgr,
+		config:      config,
+		deployments: make(map[string]*scaledDeployment),
+		now:         time.Now,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Reads the autoscaler settings from the config
+func autoscaleConfigFromViper() (autoscaleConfig, error) {
+	config := autoscaleConfig{
+		enabled:           viper.GetBool("autoscale.enabled"),
+		idleTimeout:       viper.GetDuration("autoscale.idle_timeout"),
+		interval:          viper.GetDuration("autoscale.interval"),
+		targetConcurrency: viper.GetFloat64("autoscale.target_concurrency"),
+		targetLatency:     viper.GetDuration("autoscale.target_latency"),
+		scaleUpCooldown:   viper.GetDuration("autoscale.scale_up_cooldown"),
+		scaleDownCooldown: viper.GetDuration("autoscale.scale_down_cooldown"),
+	}
+
+	if config.interval <= 0 {
+		config.interval = 10 * time.Second
+	}
+	if config.enabled && config.targetConcurrency <= 0 {
+		return config, errors.New("autoscale.target_concurrency must be greater than 0")
+	}
+	return config, nil
+}
@@ -0,0 +1,305 @@
+package deploy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A clock that is moved forward by the tests and the fake manager
+type fakeClock struct {
+	m sync.Mutex
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// A Manager that records the replicas it is scaled to and responds after the
+// configured delay on the autoscaler's clock
+type fakeManager struct {
+	clock     *fakeClock
+	delay     time.Duration
+	startTime time.Duration // time taken to scale up
+	replicas  map[string]int
+}
+
+func (f *fakeManager) Close() error { return nil }
+
+func (f *fakeManager) DeployInstance(d Deployment) error {
+	_ = d.validate()
+	f.replicas[d.Address()] = d.MinReplica
+	return nil
+}
+
+func (f *fakeManager) Reconcile(desired []Deployment) error {
+	want := make(map[string]bool)
+	for _, d := range desired {
+		_ = d.validate()
+		want[d.Address()] = true
+		if _, ok := f.replicas[d.Address()]; !ok {
+			f.replicas[d.Address()] = d.MinReplica
+		}
+	}
+	for addr := range f.replicas {
+		if !want[addr] {
+			delete(f.replicas, addr)
+		}
+	}
+	return nil
+}
+
+func (f *fakeManager) RunInstance(r *http.Request) (*http.Response, error) {
+	f.clock.Add(f.delay)
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+}
+
+func (f *fakeManager) ScaleInstance(d Deployment, replicas int) error {
+	_ = d.validate()
+	if replicas > f.replicas[d.Address()] {
+		f.clock.Add(f.startTime)
+	}
+	f.replicas[d.Address()] = replicas
+	return nil
+}
+
+func (f *fakeManager) StopInstance(d Deployment) error {
+	_ = d.validate()
+	delete(f.replicas, d.Address())
+	return nil
+}
+
+func newFakeAutoscaler(config autoscaleConfig) (*autoscaler, *fakeManager) {
+	mgr := &fakeManager{clock: &fakeClock{t: time.Unix(0, 0)}, replicas: make(map[string]int)}
+	a := newAutoscaler(mgr, config)
+	a.now = mgr.clock.Now
+	return a, mgr
+}
+
+func TestAutoscaler_Concurrency(t *testing.T) {
+	a, mgr := newFakeAutoscaler(autoscaleConfig{
+		enabled:           true,
+		interval:          10 * time.Second,
+		targetConcurrency: 2,
+		scaleUpCooldown:   10 * time.Second,
+		scaleDownCooldown: 30 * time.Second,
+	})
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "abc", MinReplica: 1, MaxReplica: 4}))
+
+	// 6 requests in flight for the whole window need 3 replicas
+	for i := 0; i < 6; i++ {
+		a.begin("proj")
+	}
+	mgr.clock.Add(10 * time.Second)
+	a.scale()
+	assert.Equal(t, 3, mgr.replicas["proj"])
+
+	// the load exceeds the max replicas but scaling up is cooling down
+	for i := 0; i < 6; i++ {
+		a.begin("proj")
+	}
+	mgr.clock.Add(5 * time.Second)
+	a.scale()
+	assert.Equal(t, 3, mgr.replicas["proj"])
+
+	mgr.clock.Add(5 * time.Second)
+	a.scale()
+	assert.Equal(t, 4, mgr.replicas["proj"])
+
+	// idle, scales back down to min replicas once the cooldown passes
+	for i := 0; i < 12; i++ {
+		a.end("proj")
+	}
+	mgr.clock.Add(20 * time.Second)
+	a.scale()
+	assert.Equal(t, 4, mgr.replicas["proj"])
+
+	mgr.clock.Add(10 * time.Second)
+	a.scale()
+	assert.Equal(t, 1, mgr.replicas["proj"])
+}
+
+func TestAutoscaler_Latency(t *testing.T) {
+	a, mgr := newFakeAutoscaler(autoscaleConfig{
+		enabled:           true,
+		interval:          10 * time.Second,
+		targetConcurrency: 100,
+		targetLatency:     time.Second,
+	})
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Alias: "dev", Hash: "abc", MinReplica: 1, MaxReplica: 2}))
+
+	mgr.delay = 2 * time.Second
+	resp, err := a.RunInstance(newExecRequest("proj", "dev"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	a.scale()
+	assert.Equal(t, 2, mgr.replicas["proj/dev"])
+
+	// already at max replicas
+	resp, err = a.RunInstance(newExecRequest("proj", "dev"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	a.scale()
+	assert.Equal(t, 2, mgr.replicas["proj/dev"])
+}
+
+func TestAutoscaler_InFlightUntilBodyClosed(t *testing.T) {
+	a, _ := newFakeAutoscaler(autoscaleConfig{enabled: true, interval: time.Second, targetConcurrency: 1})
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "abc", MinReplica: 1, MaxReplica: 2}))
+
+	// the response is still being streamed back once its headers arrived
+	resp, err := a.RunInstance(newExecRequest("proj", "latest"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, a.deployments["proj"].inFlight)
+	assert.Equal(t, 1, a.deployments["proj"].completed)
+
+	assert.Nil(t, resp.Body.Close())
+	assert.Nil(t, resp.Body.Close())
+	assert.Equal(t, 0, a.deployments["proj"].inFlight)
+}
+
+func TestAutoscaler_StopInstance(t *testing.T) {
+	a, _ := newFakeAutoscaler(autoscaleConfig{enabled: true, interval: time.Second, targetConcurrency: 1})
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "old"}))
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "new"}))
+
+	// stopping the replaced deployment keeps observing its successor
+	assert.Nil(t, a.StopInstance(Deployment{Project: "proj", Hash: "old"}))
+	assert.Contains(t, a.deployments, "proj")
+
+	assert.Nil(t, a.StopInstance(Deployment{Project: "proj", Hash: "new"}))
+	assert.NotContains(t, a.deployments, "proj")
+}
+
+func TestAutoscaler_ScaleToZero(t *testing.T) {
+	a, mgr := newFakeAutoscaler(autoscaleConfig{
+		interval:    10 * time.Second,
+		idleTimeout: time.Minute,
+	})
+	mgr.startTime = 1500 * time.Millisecond
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "abc", MinReplica: 0, MaxReplica: 2}))
+	assert.Equal(t, 0, mgr.replicas["proj"])
+
+	// the first request starts a replica and reports the wait
+	resp, err := a.RunInstance(newExecRequest("proj", "latest"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1.5s", resp.Header.Get(ColdStartHeader))
+	assert.Equal(t, 1, mgr.replicas["proj"])
+	resp.Body.Close()
+
+	resp, err = a.RunInstance(newExecRequest("proj", "latest"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", resp.Header.Get(ColdStartHeader))
+	resp.Body.Close()
+
+	// load based scaling is disabled, so the replica is only stopped once idle
+	mgr.clock.Add(30 * time.Second)
+	a.scale()
+	assert.Equal(t, 1, mgr.replicas["proj"])
+
+	mgr.clock.Add(30 * time.Second)
+	a.scale()
+	assert.Equal(t, 0, mgr.replicas["proj"])
+
+	resp, err = a.RunInstance(newExecRequest("proj", "latest"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1.5s", resp.Header.Get(ColdStartHeader))
+	assert.Equal(t, 1, mgr.replicas["proj"])
+	resp.Body.Close()
+}
+
+func TestAutoscaler_KeepsMinReplicas(t *testing.T) {
+	a, mgr := newFakeAutoscaler(autoscaleConfig{
+		enabled:           true,
+		interval:          10 * time.Second,
+		idleTimeout:       time.Minute,
+		targetConcurrency: 1,
+	})
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "abc", MinReplica: 1, MaxReplica: 2}))
+
+	mgr.clock.Add(time.Hour)
+	a.scale()
+	assert.Equal(t, 1, mgr.replicas["proj"])
+}
+
+func TestAutoscaler_Reconcile(t *testing.T) {
+	a, mgr := newFakeAutoscaler(autoscaleConfig{enabled: true, interval: time.Second, targetConcurrency: 1})
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Hash: "abc"}))
+	assert.Nil(t, a.DeployInstance(Deployment{Project: "proj", Alias: "dev", Hash: "abc"}))
+	a.begin("proj")
+
+	assert.Nil(t, a.Reconcile([]Deployment{
+		{Project: "proj", Hash: "abc"},
+		{Project: "other", Hash: "def", MinReplica: 2, MaxReplica: 2},
+	}))
+	assert.Equal(t, map[string]int{"proj": 1, "other": 2}, mgr.replicas)
+	assert.Len(t, a.deployments, 2)
+	// the load of deployments that were already observed is kept
+	assert.Equal(t, 1, a.deployments["proj"].inFlight)
+	assert.Equal(t, 2, a.deployments["other"].replicas)
+}
+
+func TestAutoscaler_ScaleToZeroAfterColdStart(t *testing.T) {
+	a, mgr := newFakeAutoscaler(autoscaleConfig{
+		interval:    10 * time.Second,
+		idleTimeout: time.Minute,
+	})
+	d := Deployment{Project: "proj", Hash: "abc", MinReplica: 0, MaxReplica: 2}
+	assert.Nil(t, a.DeployInstance(d))
+	assert.Nil(t, a.ScaleInstance(d, 1))
+
+	// the deployment is found idle, but a request starts it again before the scale
+	// down is applied
+	mgr.clock.Add(time.Minute)
+	actions := a.evaluate()
+	assert.Len(t, actions, 1)
+
+	resp, err := a.RunInstance(newExecRequest("proj", "latest"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", resp.Header.Get(ColdStartHeader))
+	assert.Equal(t, 1, mgr.replicas["proj"])
+	resp.Body.Close()
+
+	for _, action := range actions {
+		assert.Nil(t, a.ScaleInstance(action.deployment, action.replicas))
+	}
+	assert.Equal(t, 1, mgr.replicas["proj"])
+	assert.Equal(t, 1, a.deployments["proj"].replicas)
+
+	// a request that arrived but has yet to wait on the start also keeps it running
+	mgr.clock.Add(time.Minute)
+	actions = a.evaluate()
+	assert.Len(t, actions, 1)
+	a.begin("proj")
+	for _, action := range actions {
+		assert.Nil(t, a.ScaleInstance(action.deployment, action.replicas))
+	}
+	started, err := a.coldStart(context.Background(), "proj")
+	assert.Nil(t, err)
+	assert.True(t, started)
+	a.end("proj")
+	assert.Equal(t, 1, mgr.replicas["proj"])
+	assert.Equal(t, 1, a.deployments["proj"].replicas)
+
+	// once idle, the scale down goes through
+	mgr.clock.Add(time.Minute)
+	a.scale()
+	assert.Equal(t, 0, mgr.replicas["proj"])
+}
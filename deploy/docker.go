@@ -5,15 +5,23 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
 	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 
 	"warden/store"
+	"warden/store/model"
+	"warden/utils"
 )
 
 const (
@@ -21,102 +29,420 @@ const (
 	dockerPortMax = 42673
 )
 
-var localIP string // A singleton string representing the IP address of the local machine.
+// Address the containers are published on. Only warden reaches them, so they aren't
+// exposed to the rest of the network
+const localIP = "127.0.0.1"
 
-func init() {
-	if ip, err := getLocalIPAddress(); err != nil {
-		log.Fatalln(err)
-	} else {
-		localIP = ip
-	}
+type dockerManager struct {
+	routes    *routeMap
+	client    *http.Client // forwards the requests to the replicas
+	db        *store.Store
+	ctx       context.Context
+	cli       *client.Client
+	readiness probe
+	liveness  probe
+	lock      sync.Mutex
+	replicas  map[string]replica // running replicas keyed by their route
+	ports     *portAllocator     // host ports the containers are published on
+	port      int                // port the instances listen on within their container
+	limits    resourceLimits
+	stop      chan struct{}
 }
 
-type dockerManager struct {
-	routes *routeMap
-	db     *store.Store
-	ctx    context.Context
-	cli    *client.Client
+// A container running one of the deployment's replicas
+type replica struct {
+	deployment Deployment
+	index      int
+	id         string // container ID
+	port       int    // host port the container is published on
 }
 
-// Deploys an instance of the container on the Docker daemon
+// Deploys MinReplica containers of the instance on the Docker daemon. The deployment's
+// address is routed to the new containers once they are all started, replacing any
+// existing routes. If any container fails to start, the ones already started are
+// removed
 func (m *dockerManager) DeployInstance(d Deployment) error {
-	port, err := findFreePort(dockerPortMin, dockerPortMax)
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	var routes []string
+	for i := 0; i < d.MinReplica; i++ {
+		route, err := m.startReplica(d, i)
+		if err != nil {
+			if err := m.StopInstance(d); err != nil {
+				log.Println(err)
+			}
+			return err
+		}
+		routes = append(routes, route)
+	}
+	m.routes.Set(d.Address(), routes...)
+
+	return nil
+}
+
+// Starts a container of the deployment published on a free host port and waits for it to pass the
+// readiness probe. Returns the route to the container
+func (m *dockerManager) startReplica(d Deployment, index int) (string, error) {
+	port, err := m.ports.Allocate()
 	if err != nil {
-		return errors.Wrap(err, "could not find free port for deployment")
+		return "", errors.Wrap(err, "could not find free port for deployment")
 	}
+	natPort := nat.Port(fmt.Sprintf("%d/tcp", m.port))
 	con, err := m.cli.ContainerCreate(
 		m.ctx,
 		&container.Config{
 			Image:        d.ImageName(),
-			ExposedPorts: nat.PortSet{nat.Port(port): struct{}{}},
+			ExposedPorts: nat.PortSet{natPort: struct{}{}},
+			Labels:       replicaLabels(d, index),
+			Env:          d.envList(),
 		},
 		&container.HostConfig{
-			PortBindings: map[nat.Port][]nat.PortBinding{nat.Port(port): {{HostIP: "localhost", HostPort: string(port)}}},
+			PortBindings: map[nat.Port][]nat.PortBinding{natPort: {{HostIP: localIP, HostPort: strconv.Itoa(port)}}},
 			AutoRemove:   true,
+			Resources:    containerResources(m.limits.apply(d)),
 		},
 		nil,
-		d.ImageName())
+		d.replicaName(index))
 
 	if err != nil {
-		return errors.Wrap(err, "could not create instance")
+		m.ports.Release(port)
+		return "", errors.Wrap(err, "could not create instance")
 	}
 	if err := m.cli.ContainerStart(m.ctx, con.ID, types.ContainerStartOptions{}); err != nil {
-		return errors.Wrap(err, "could not start instance")
+		m.removeFailedReplica(d, index, con.ID, port)
+		return "", errors.Wrap(err, "could not start instance")
 	}
-	m.routes.Set(d.Address(), fmt.Sprintf("%s:%d", localIP, port))
 
-	return nil
+	route := fmt.Sprintf("%s:%d", localIP, port)
+	if err := m.readiness.waitReady(route); err != nil {
+		m.removeFailedReplica(d, index, con.ID, port)
+		return "", err
+	}
+
+	m.lock.Lock()
+	m.replicas[route] = replica{d, index, con.ID, port}
+	m.lock.Unlock()
+	return route, nil
 }
 
-// Stops the instance of the container on the Docker daemon. If deployment doesn't exist,
-// nothing is done
+// Removes a container that failed to start. Its port is only released once the
+// container is gone
+func (m *dockerManager) removeFailedReplica(d Deployment, index int, id string, port int) {
+	if err := m.cli.ContainerRemove(m.ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+		log.Println(errors.Wrapf(err, "error removing container: %s", d.replicaName(index)))
+		return
+	}
+	m.ports.Release(port)
+}
+
+// Stops the containers of the deployment on the Docker daemon. If deployment doesn't
+// exist, nothing is done. Only the routes to the stopped containers are removed, so a
+// deployment that has been replaced can be stopped safely. The requests in flight to
+// the containers are drained before they are stopped
 func (m *dockerManager) StopInstance(d Deployment) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	// every replica is taken out of the routes first so that they drain together
+	replicas := m.listReplicas(d)
+	for _, con := range replicas {
+		m.unrouteReplica(d, con)
+	}
+	for _, con := range replicas {
+		if err := m.removeReplica(d, con); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts or removes containers until the deployment runs the number of replicas.
+// New replicas are added to the deployment's routes as soon as they start
+func (m *dockerManager) ScaleInstance(d Deployment, replicas int) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	if replicas < 0 {
+		return errors.Errorf("cannot scale deployment to %d replicas", replicas)
+	}
+
+	// replicas are ordered by index so that the newest ones are removed first
+	containers := m.listReplicas(d)
+	for len(containers) > replicas {
+		last := containers[len(containers)-1]
+		if err := m.removeReplica(d, last); err != nil {
+			return err
+		}
+		containers = containers[:len(containers)-1]
+	}
+
+	used := make(map[int]bool)
+	for _, con := range containers {
+		used[replicaIndex(con)] = true
+	}
+	for i, running := 0, len(containers); running < replicas; i++ {
+		if used[i] {
+			continue
+		}
+		route, err := m.startReplica(d, i)
+		if err != nil {
+			return err
+		}
+		m.routes.Add(d.Address(), route)
+		running++
+	}
+	return nil
+}
+
+// Reconciles the containers on the Docker daemon with the desired deployments.
+// Containers are matched to the deployments by their labels. The replicas of desired
+// deployments are routed to and started up to MinReplica, the deployments that have
+// no containers are deployed and containers of other deployments are removed
+func (m *dockerManager) Reconcile(desired []Deployment) error {
+	want := make(map[string]Deployment)
+	for _, d := range desired {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		want[d.key()] = d
+	}
+
 	ftr := filters.NewArgs()
-	ftr.Add("name", d.ImageName())
-	containers, _ := m.cli.ContainerList(
+	ftr.Add("label", labelAddress)
+	containers, err := m.cli.ContainerList(m.ctx, types.ContainerListOptions{Filters: ftr})
+	if err != nil {
+		return errors.Wrap(err, "error listing warden containers")
+	}
+	found := make(map[string][]types.Container)
+	for _, con := range containers {
+		d := deploymentFromLabels(con.Labels)
+		key := d.key()
+		// containers of the commit left behind by a previous deployment are strays too
+		if w, ok := want[key]; ok && !w.sameAs(d) {
+			key = fmt.Sprintf("%s#%d", key, d.DeploymentID)
+		}
+		found[key] = append(found[key], con)
+	}
+
+	var errs []string
+	adopted := make(map[string]replica)
+	for key, cons := range found {
+		d, ok := want[key]
+		if !ok {
+			stray := deploymentFromLabels(cons[0].Labels)
+			log.Printf("removing containers of '%s' as it is no longer deployed", key)
+			for _, con := range cons {
+				if err := m.removeReplica(stray, con); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			continue
+		}
+		for _, con := range cons {
+			index := replicaIndex(con)
+			for _, port := range con.Ports {
+				if port.PublicPort != 0 {
+					m.ports.Reserve(int(port.PublicPort))
+					adopted[fmt.Sprintf("%s:%d", localIP, port.PublicPort)] = replica{d, index, con.ID, int(port.PublicPort)}
+				}
+			}
+		}
+	}
+	m.adoptReplicas(adopted)
+
+	for key, d := range want {
+		var err error
+		if running := len(found[key]); running == 0 {
+			err = m.DeployInstance(d)
+		} else if running < d.MinReplica {
+			err = m.ScaleInstance(d, d.MinReplica)
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not reconcile '%s'", key).Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Tracks and routes to the replicas found on the Docker daemon. Routes to replicas
+// that have gone away are left to the liveness probe and eviction to remove
+func (m *dockerManager) adoptReplicas(adopted map[string]replica) {
+	m.lock.Lock()
+	for route, r := range adopted {
+		m.replicas[route] = r
+	}
+	m.lock.Unlock()
+
+	for route, r := range adopted {
+		m.routes.Add(r.deployment.Address(), route)
+	}
+}
+
+// Lists the containers running the deployment's replicas ordered by replica index
+func (m *dockerManager) listReplicas(d Deployment) []types.Container {
+	replicas, _ := m.cli.ContainerList(
 		m.ctx,
 		types.ContainerListOptions{
-			Filters: ftr,
+			Filters: d.labelFilters(),
 			All:     true})
 
-	for _, con := range containers {
-		if err := m.cli.ContainerRemove(m.ctx, con.ID, types.ContainerRemoveOptions{
-			Force: true,
-		}); err != nil {
-			return errors.Wrapf(err, "error removing container: %s", d.ImageName())
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicaIndex(replicas[i]) < replicaIndex(replicas[j])
+	})
+	return replicas
+}
+
+// Removes the replica's routes, waits for its requests in flight to complete, then
+// removes the replica's container
+func (m *dockerManager) removeReplica(d Deployment, con types.Container) error {
+	for _, route := range m.unrouteReplica(d, con) {
+		m.routes.Drain(route)
+	}
+	if err := m.cli.ContainerRemove(m.ctx, con.ID, types.ContainerRemoveOptions{
+		Force: true,
+	}); err != nil {
+		return errors.Wrapf(err, "error removing container: %s", con.Names[0])
+	}
+	for _, port := range con.Ports {
+		if port.PublicPort != 0 {
+			m.ports.Release(int(port.PublicPort))
 		}
 	}
-	m.routes.Delete(d.Address())
 	return nil
 }
 
-// Runs the instance s
+// Removes the routes to the replica. Returns the removed routes
+func (m *dockerManager) unrouteReplica(d Deployment, con types.Container) []string {
+	var routes []string
+	for _, port := range con.Ports {
+		if port.PublicPort != 0 {
+			route := fmt.Sprintf("%s:%d", localIP, port.PublicPort)
+			m.routes.DeleteIf(d.Address(), route)
+			m.lock.Lock()
+			delete(m.replicas, route)
+			m.lock.Unlock()
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// Runs the instance specified by the request's project and alias. The response
+// returned is the instance's response and it is up to the caller to close its body
 func (m *dockerManager) RunInstance(r *http.Request) (*http.Response, error) {
-	payload, err := NewPayload(r)
-	if err != nil {
-		return nil, errors.Wrap(err, "error forming payload")
+	return runInstance(m.client, m.routes, r)
+}
+
+// Checks the liveness of every replica at each interval
+func (m *dockerManager) watchLiveness() {
+	ticker := time.NewTicker(m.liveness.interval)
+	defer ticker.Stop()
+
+	failures := make(map[string]int)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.checkLiveness(failures)
+		}
 	}
+}
 
-	resp, err := payload.Execute(m.routes.Get(payload.Address()))
+// Probes every replica once. Replicas that fail the liveness probe too many times in
+// a row are taken out of the route and restarted. Replicas that were evicted after
+// failed requests are routed to again once they pass the probe. The failures are
+// counted by route across calls
+func (m *dockerManager) checkLiveness(failures map[string]int) {
+	m.lock.Lock()
+	replicas := make(map[string]replica, len(m.replicas))
+	for route, r := range m.replicas {
+		replicas[route] = r
+	}
+	m.lock.Unlock()
+
+	for route := range failures {
+		if _, ok := replicas[route]; !ok {
+			delete(failures, route)
+		}
+	}
+	for route, r := range replicas {
+		if err := m.liveness.check(route); err == nil {
+			delete(failures, route)
+			if m.routes.Restore(route) {
+				log.Printf("replica '%s' at '%s' passed its liveness probe after it was evicted, routing to it again", r.deployment.replicaName(r.index), route)
+			}
+			continue
+		}
+		if failures[route]++; failures[route] < m.liveness.failures {
+			continue
+		}
+		delete(failures, route)
+		if err := m.restartReplica(route, r); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Replaces the unhealthy replica at the route with a new container
+func (m *dockerManager) restartReplica(route string, r replica) error {
+	log.Printf("replica '%s' at '%s' failed its liveness probe, restarting", r.deployment.replicaName(r.index), route)
+
+	addr := r.deployment.Address()
+	m.routes.DeleteIf(addr, route)
+	m.lock.Lock()
+	delete(m.replicas, route)
+	m.lock.Unlock()
+
+	if err := m.cli.ContainerRemove(m.ctx, r.id, types.ContainerRemoveOptions{Force: true}); err != nil {
+		return errors.Wrapf(err, "error removing unhealthy container: %s", r.deployment.replicaName(r.index))
+	}
+	m.ports.Release(r.port)
+	newRoute, err := m.startReplica(r.deployment, r.index)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error encountered when running requested instance. \n%+v\n", payload)
+		return errors.Wrapf(err, "error restarting unhealthy container: %s", r.deployment.replicaName(r.index))
 	}
-	return resp, nil
+	m.routes.Add(addr, newRoute)
+	return nil
 }
 
-func (m *dockerManager) Close() error {
-	containers, err := m.cli.ContainerList(m.ctx, types.ContainerListOptions{All: true})
+// Reserves the ports published by the containers that warden started before it was
+// restarted so that they aren't assigned to new containers
+func (m *dockerManager) recoverPorts() error {
+	ftr := filters.NewArgs()
+	ftr.Add("label", labelAddress)
+	containers, err := m.cli.ContainerList(m.ctx, types.ContainerListOptions{Filters: ftr, All: true})
 	if err != nil {
-		return errors.Wrap(err, "error getting all the containers for docker daemon shutdown")
+		return errors.Wrap(err, "error listing warden containers")
 	}
-	// Remove all containers with public ports within range
 	for _, con := range containers {
 		for _, port := range con.Ports {
-			if dockerPortMin <= port.PublicPort && port.PublicPort < dockerPortMax {
-				if err := m.cli.ContainerRemove(m.ctx, con.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
-					return errors.Wrapf(err, "error trying to remove container with image: %s ", con.ImageID)
-				}
-				break
+			if port.PublicPort != 0 {
+				m.ports.Reserve(int(port.PublicPort))
+			}
+		}
+	}
+	return nil
+}
+
+// Stops watching the replicas and closes the Docker client. Containers are left
+// running to be adopted when warden restarts unless deploy.remove_on_exit is set
+func (m *dockerManager) Close() error {
+	close(m.stop)
+
+	if viper.GetBool("deploy.remove_on_exit") {
+		ftr := filters.NewArgs()
+		ftr.Add("label", labelAddress)
+		containers, err := m.cli.ContainerList(m.ctx, types.ContainerListOptions{Filters: ftr, All: true})
+		if err != nil {
+			return errors.Wrap(err, "error getting all the containers for docker daemon shutdown")
+		}
+		for _, con := range containers {
+			if err := m.cli.ContainerRemove(m.ctx, con.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+				return errors.Wrapf(err, "error trying to remove container with image: %s ", con.ImageID)
 			}
 		}
 	}
@@ -141,7 +467,82 @@ func newDockerRunner() (*dockerManager, error) {
 		return nil, err
 	}
 
+	port := viper.GetInt("deploy.port")
+	if port <= 0 || port > 65535 {
+		return nil, errors.Errorf("deploy.port must be a valid port that the instances listen on, got %d", port)
+	}
+
 	rm := newRouteMap()
+	switch balance := utils.StrLowerTrim(viper.GetString("deploy.balance")); balance {
+	case "", balanceRoundRobin:
+	case balanceLeastConnections:
+		rm.balance = balance
+	default:
+		return nil, errors.Errorf("Unknown balance strategy '%s'. Must be one of %s or %s", balance, balanceRoundRobin, balanceLeastConnections)
+	}
+	rm.evictAfter = viper.GetInt64("deploy.evict_after")
+
+	limits, err := resourceLimitsFromViper()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &dockerManager{
+		routes:    rm,
+		client:    newInstanceClient(transportConfigFromViper()),
+		db:        db,
+		ctx:       ctx,
+		cli:       cli,
+		readiness: probeFromViper("deploy.readiness"),
+		liveness:  probeFromViper("deploy.liveness"),
+		replicas:  make(map[string]replica),
+		ports:     newPortAllocator(dockerPortMin, dockerPortMax),
+		port:      port,
+		limits:    limits,
+		stop:      make(chan struct{}),
+	}
+	if err := m.recoverPorts(); err != nil {
+		return nil, err
+	}
+	if m.liveness.interval > 0 {
+		go m.watchLiveness()
+	} else if rm.evictAfter > 0 {
+		// nothing would route to the evicted replicas again
+		log.Println("deploy.evict_after is ignored as the liveness probe is disabled")
+		rm.evictAfter = 0
+	}
+	return m, nil
+}
 
-	return &dockerManager{rm, db, ctx, cli}, nil
+// Converts the limits to the container's cgroup settings and ulimits
+func containerResources(r model.Resources) container.Resources {
+	res := container.Resources{
+		Memory:    r.Memory,
+		CPUShares: r.CPUShares,
+		CPUQuota:  r.CPUQuota,
+		PidsLimit: r.PidsLimit,
+	}
+	if r.CPUQuota > 0 {
+		res.CPUPeriod = cpuPeriod
+	}
+	if r.MaxOpenFiles > 0 {
+		res.Ulimits = []*units.Ulimit{{Name: "nofile", Soft: r.MaxOpenFiles, Hard: r.MaxOpenFiles}}
+	}
+	return res
+}
+
+// Gets the labels of the container running the deployment's replica
+func replicaLabels(d Deployment, index int) map[string]string {
+	labels := d.labels()
+	labels[labelReplica] = strconv.Itoa(index)
+	return labels
+}
+
+// Gets the replica index of the container from its labels. Returns -1 if the
+// container is not labelled as a replica
+func replicaIndex(con types.Container) int {
+	if i, err := strconv.Atoi(con.Labels[labelReplica]); err == nil && i >= 0 {
+		return i
+	}
+	return -1
 }
@@ -0,0 +1,249 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Forms a request to the project and alias as it would arrive from the /e/ routes
+func newExecRequest(project, alias string) *http.Request {
+	r := httptest.NewRequest("GET", "/e/"+project+"/"+alias, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("project", project)
+	rctx.URLParams.Add("alias", alias)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestDockerManager_RunInstance(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Instance", "up")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	// reserve a port and release it so that nothing is listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	m := &dockerManager{routes: newRouteMap(), client: newInstanceClient(transportConfigFromViper())}
+	m.routes.Set("proj/dev", strings.TrimPrefix(srv.URL, "http://"))
+	m.routes.Set("proj/dead", deadAddr)
+
+	resp, err := m.RunInstance(newExecRequest("proj", "dev"))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "up", resp.Header.Get("X-Instance"))
+	assert.Equal(t, "hello", string(body))
+
+	_, err = m.RunInstance(newExecRequest("proj", "no-exist"))
+	assert.Equal(t, ErrInstanceNotFound, errors.Cause(err))
+
+	_, err = m.RunInstance(newExecRequest("proj", "dead"))
+	assert.Equal(t, ErrInstanceUnreachable, errors.Cause(err))
+}
+
+func TestDockerManager_RunInstanceEvictsDeadReplica(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	m := &dockerManager{routes: newRouteMap(), client: newInstanceClient(transportConfigFromViper())}
+	m.routes.evictAfter = 1
+	m.routes.Set("proj", deadAddr, strings.TrimPrefix(srv.URL, "http://"))
+
+	_, err = m.RunInstance(newExecRequest("proj", "latest"))
+	assert.Equal(t, ErrInstanceUnreachable, errors.Cause(err))
+	assert.Equal(t, []string{strings.TrimPrefix(srv.URL, "http://")}, m.routes.Routes("proj"))
+
+	for i := 0; i < 2; i++ {
+		resp, err := m.RunInstance(newExecRequest("proj", "latest"))
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+}
+
+func TestDockerManager_RunInstanceEveryReplicaEvicted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	m := &dockerManager{routes: newRouteMap(), client: newInstanceClient(transportConfigFromViper())}
+	m.routes.evictAfter = 1
+	m.routes.Set("proj", deadAddr)
+
+	// the deployment is still there, its replicas just can't be reached
+	for i := 0; i < 2; i++ {
+		_, err = m.RunInstance(newExecRequest("proj", "latest"))
+		assert.Equal(t, ErrInstanceUnreachable, errors.Cause(err))
+	}
+}
+
+func TestDockerManager_CheckLivenessRestoresEvictedReplica(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	route := strings.TrimPrefix(srv.URL, "http://")
+
+	d := Deployment{Project: "proj", Hash: "abc"}
+	m := &dockerManager{
+		routes:   newRouteMap(),
+		liveness: probe{timeout: time.Second, failures: 3},
+		replicas: map[string]replica{route: {deployment: d}},
+	}
+	m.routes.evictAfter = 1
+	m.routes.Set("proj", route)
+	m.routes.Release("proj", m.routes.Acquire("proj"), true)
+	assert.Equal(t, "", m.routes.Get("proj"))
+
+	// the replica recovered, i.e. after a restart of its process
+	m.checkLiveness(make(map[string]int))
+	assert.Equal(t, []string{route}, m.routes.Routes("proj"))
+
+	// replicas that were not evicted, i.e. of a deployment that isn't routed to yet,
+	// are left alone
+	m.routes.Delete("proj")
+	m.checkLiveness(make(map[string]int))
+	assert.Equal(t, "", m.routes.Get("proj"))
+}
+
+func TestReplicaIndex(t *testing.T) {
+	d := Deployment{Project: "proj", Alias: "dev", Hash: "abc"}
+	assert.Equal(t, 0, replicaIndex(types.Container{Labels: replicaLabels(d, 0)}))
+	assert.Equal(t, 12, replicaIndex(types.Container{Labels: replicaLabels(d, 12)}))
+	assert.Equal(t, -1, replicaIndex(types.Container{Labels: d.labels()}))
+	assert.Equal(t, -1, replicaIndex(types.Container{Labels: map[string]string{labelReplica: "x"}}))
+}
+
+// A fake of the Docker API that lists and removes containers kept in memory. Only
+// label filters are applied
+type fakeDocker struct {
+	m          sync.Mutex
+	containers []types.Container
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1.25")
+	switch {
+	case r.Method == "GET" && path == "/containers/json":
+		ftr, err := filters.FromParam(r.URL.Query().Get("filters"))
+		if err != nil {
+			http.Error(w, `{"message": "invalid filters"}`, http.StatusBadRequest)
+			return
+		}
+		containers := []types.Container{}
+		for _, con := range f.containers {
+			if ftr.MatchKVList("label", con.Labels) {
+				containers = append(containers, con)
+			}
+		}
+		json.NewEncoder(w).Encode(containers)
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/containers/"):
+		id := strings.TrimPrefix(path, "/containers/")
+		for i, con := range f.containers {
+			if con.ID == id {
+				f.containers = append(f.containers[:i], f.containers[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+	default:
+		http.Error(w, `{"message": "not implemented"}`, http.StatusNotImplemented)
+	}
+}
+
+func TestDockerManager_Reconcile(t *testing.T) {
+	kept := Deployment{Project: "proj", Alias: "dev", Hash: "abc", MinReplica: 1, MaxReplica: 1}
+	stray := Deployment{Project: "proj", Alias: "dev", Hash: "old", MinReplica: 1, MaxReplica: 1}
+	missing := Deployment{Project: "other", Hash: "def", MinReplica: 0, MaxReplica: 1}
+
+	fake := &fakeDocker{containers: []types.Container{
+		{ID: "kept", Labels: replicaLabels(kept, 0), Ports: []types.Port{{PublicPort: 40001}}},
+		{ID: "stray", Labels: replicaLabels(stray, 0), Ports: []types.Port{{PublicPort: 40002}}},
+	}}
+	m, closeFake := newFakeDockerManager(t, fake)
+	defer closeFake()
+	assert.Nil(t, m.Reconcile([]Deployment{kept, missing}))
+
+	assert.Len(t, fake.containers, 1)
+	assert.Equal(t, "kept", fake.containers[0].ID)
+	assert.Equal(t, []string{localIP + ":40001"}, m.routes.Routes("proj/dev"))
+	assert.Equal(t, "kept", m.replicas[localIP+":40001"].id)
+}
+
+func TestDockerManager_StopInstance(t *testing.T) {
+	d := Deployment{Project: "proj", Alias: "dev", Hash: "abc", MinReplica: 2, MaxReplica: 2}
+	other := Deployment{Project: "proj", Alias: "dev", Hash: "def", MinReplica: 1, MaxReplica: 1}
+
+	fake := &fakeDocker{containers: []types.Container{
+		{ID: "first", Labels: replicaLabels(d, 0), Ports: []types.Port{{PublicPort: 40001}}},
+		{ID: "second", Labels: replicaLabels(d, 1), Ports: []types.Port{{PublicPort: 40002}}},
+		{ID: "other", Labels: replicaLabels(other, 0), Ports: []types.Port{{PublicPort: 40003}}},
+		{ID: "unlabelled", Ports: []types.Port{{PublicPort: 40004}}},
+	}}
+	m, closeFake := newFakeDockerManager(t, fake)
+	defer closeFake()
+
+	replicas := m.listReplicas(d)
+	assert.Len(t, replicas, 2)
+	assert.Equal(t, "first", replicas[0].ID)
+	assert.Equal(t, "second", replicas[1].ID)
+
+	assert.Nil(t, m.recoverPorts())
+	assert.Equal(t, map[int]bool{40001: true, 40002: true, 40003: true}, m.ports.assigned)
+
+	m.routes.Set("proj/dev", localIP+":40001", localIP+":40002", localIP+":40003")
+	assert.Nil(t, m.StopInstance(d))
+	assert.Equal(t, map[int]bool{40003: true}, m.ports.assigned)
+
+	var ids []string
+	for _, con := range fake.containers {
+		ids = append(ids, con.ID)
+	}
+	assert.Equal(t, []string{"other", "unlabelled"}, ids)
+	assert.Equal(t, []string{localIP + ":40003"}, m.routes.Routes("proj/dev"))
+}
+
+// Creates a dockerManager talking to the fake Docker API
+func newFakeDockerManager(t *testing.T, fake *fakeDocker) (*dockerManager, func()) {
+	srv := httptest.NewServer(fake)
+	cli, err := client.NewClient("tcp://"+srv.Listener.Addr().String(), "1.25", &http.Client{Transport: &http.Transport{}}, nil)
+	assert.Nil(t, err)
+
+	m := &dockerManager{
+		routes:   newRouteMap(),
+		ctx:      context.Background(),
+		cli:      cli,
+		replicas: make(map[string]replica),
+		ports:    newPortAllocator(40000, 40010),
+	}
+	return m, srv.Close
+}
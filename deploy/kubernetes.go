@@ -0,0 +1,585 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"warden/store/model"
+	"warden/utils"
+)
+
+// Label selecting the pods that serve an address. Its value is the AddressName
+const labelName = "warden.name"
+
+// Time between checks of a Deployment's rollout
+const rolloutInterval = 500 * time.Millisecond
+
+// Deploys instances onto a Kubernetes cluster. Each address (project and alias) is
+// served by a Deployment and a Service of the same name. Deploying another commit
+// to the address updates the Deployment in place so that Kubernetes rolls the pods
+// over while the route to the Service stays the same. The readiness and liveness
+// probes are run by the kubelet.
+//
+// The environment variables of each deployment are kept in a Secret that the pods
+// refer to, so that secret values are not written into the Deployment's spec
+type kubernetesManager struct {
+	routes    *routeMap
+	client    *http.Client // forwards the requests to the services
+	ctx       context.Context
+	cli       kubernetes.Interface
+	namespace string
+	port      int32 // port the instances listen on
+	readiness probe
+	liveness  probe
+	limits    resourceLimits
+
+	waitReady   func(route string) error                  // waits for the service to pass the readiness probe
+	waitRollout func(name string, generation int64) error // waits for the Deployment's pods to run its spec
+}
+
+// Deploys an instance as a Kubernetes Deployment with MinReplica replicas behind a
+// Service. If the address is already deployed, the Deployment is updated with the
+// new commit instead. Returns once the pods of the new commit are rolled out
+func (m *kubernetesManager) DeployInstance(d Deployment) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	warnProcessLimits(d, "kubernetes")
+
+	if err := m.applySecret(d); err != nil {
+		return err
+	}
+
+	deployments := m.cli.AppsV1().Deployments(m.namespace)
+	dep := m.deploymentSpec(d)
+	existing, err := deployments.Get(dep.Name, metav1.GetOptions{})
+	created := apierrors.IsNotFound(err)
+	var applied *appsv1.Deployment
+	switch {
+	case created:
+		applied, err = deployments.Create(dep)
+	case err == nil:
+		dep.ResourceVersion = existing.ResourceVersion
+		applied, err = deployments.Update(dep)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not deploy instance: %s", dep.Name)
+	}
+
+	// the pods of the previous commit keep their Secret until they are rolled over,
+	// older ones are no longer used
+	keep := []string{secretName(d)}
+	if existing != nil && !created {
+		keep = append(keep, podSecret(existing))
+	}
+	if err := m.pruneSecrets(d, keep...); err != nil {
+		log.Println(err)
+	}
+
+	services := m.cli.CoreV1().Services(m.namespace)
+	svc := m.serviceSpec(d)
+	if _, err := services.Get(svc.Name, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		if _, err := services.Create(svc); err != nil {
+			return errors.Wrapf(err, "could not create service: %s", svc.Name)
+		}
+	} else if err != nil {
+		return errors.Wrapf(err, "could not get service: %s", svc.Name)
+	}
+
+	// an update is rolled out by Kubernetes as the new pods pass their readiness
+	// probe, the old pods serve the address until then
+	if err := m.waitRollout(applied.Name, applied.Generation); err != nil {
+		return err
+	}
+	route := m.serviceRoute(svc.Name)
+	if created && d.MinReplica > 0 {
+		if err := m.waitReady(route); err != nil {
+			return err
+		}
+	}
+	m.routes.Set(d.Address(), route)
+	return nil
+}
+
+// Removes the Deployment and Service serving the deployment's address. Nothing is
+// done if the address is not deployed or if it has since been updated to another
+// commit, so a deployment that has been replaced can be stopped safely
+func (m *kubernetesManager) StopInstance(d Deployment) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	name := d.AddressName()
+	deployments := m.cli.AppsV1().Deployments(m.namespace)
+	existing, err := deployments.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "could not get deployment: %s", name)
+	}
+	if current := deploymentFromLabels(existing.Annotations); !current.sameAs(d) {
+		return nil
+	}
+
+	// requests in flight are let through before the pods go away
+	route := m.serviceRoute(name)
+	m.routes.DeleteIf(d.Address(), route)
+	m.routes.Drain(route)
+
+	propagation := metav1.DeletePropagationBackground
+	options := &metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if err := deployments.Delete(name, options); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error removing deployment: %s", name)
+	}
+	if err := m.cli.CoreV1().Services(m.namespace).Delete(name, options); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error removing service: %s", name)
+	}
+	return m.pruneSecrets(d)
+}
+
+// Sets the number of replicas of the Deployment serving the deployment's address.
+// Nothing is done if the address has since been updated to another commit. When the
+// Deployment is started from zero replicas, waits for it to pass the readiness probe
+func (m *kubernetesManager) ScaleInstance(d Deployment, replicas int) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	if replicas < 0 {
+		return errors.Errorf("cannot scale deployment to %d replicas", replicas)
+	}
+
+	name := d.AddressName()
+	deployments := m.cli.AppsV1().Deployments(m.namespace)
+	dep, err := deployments.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not get deployment: %s", name)
+	}
+	if current := deploymentFromLabels(dep.Annotations); !current.sameAs(d) {
+		return nil
+	}
+
+	var previous int32
+	if dep.Spec.Replicas != nil {
+		previous = *dep.Spec.Replicas
+	}
+
+	count := int32(replicas)
+	dep.Spec.Replicas = &count
+	if _, err := deployments.Update(dep); err != nil {
+		return errors.Wrapf(err, "could not scale deployment: %s", name)
+	}
+
+	// the service has no endpoints until the first pod started from zero runs
+	if previous == 0 && count > 0 {
+		return m.waitReady(m.serviceRoute(name))
+	}
+	return nil
+}
+
+// Waits until the Deployment has rolled out the generation of its spec, i.e. every
+// replica runs the spec and is available, or the start timeout (deploy.start_timeout)
+// passes
+func (m *kubernetesManager) rollout(name string, generation int64) error {
+	timeout := viper.GetDuration("deploy.start_timeout")
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	deployments := m.cli.AppsV1().Deployments(m.namespace)
+	deadline := time.Now().Add(timeout)
+	for {
+		dep, err := deployments.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "could not get deployment: %s", name)
+		}
+
+		var want int32 = 1
+		if dep.Spec.Replicas != nil {
+			want = *dep.Spec.Replicas
+		}
+		status := dep.Status
+		if status.ObservedGeneration >= generation && status.UpdatedReplicas == want &&
+			status.AvailableReplicas == want && status.Replicas == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("deployment '%s' was not rolled out within %s, %d of %d replicas updated and %d available",
+				name, timeout, status.UpdatedReplicas, want, status.AvailableReplicas)
+		}
+		time.Sleep(rolloutInterval)
+	}
+}
+
+// Runs the instance specified by the request's project and alias. The response
+// returned is the instance's response and it is up to the caller to close its body
+func (m *kubernetesManager) RunInstance(r *http.Request) (*http.Response, error) {
+	return runInstance(m.client, m.routes, r)
+}
+
+// Deployments are left running on the cluster, their routes are rebuilt when the
+// manager is next created
+func (m *kubernetesManager) Close() error {
+	return nil
+}
+
+// Reconciles the Deployments on the cluster with the desired deployments. Deployments
+// are matched by the address they serve. Desired Deployments running the right commit
+// are routed to, the missing or outdated ones are deployed and Deployments serving
+// other addresses are removed
+func (m *kubernetesManager) Reconcile(desired []Deployment) error {
+	want := make(map[string]Deployment)
+	for _, d := range desired {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		want[d.Address()] = d
+	}
+
+	list, err := m.cli.AppsV1().Deployments(m.namespace).List(metav1.ListOptions{LabelSelector: labelName})
+	if err != nil {
+		return errors.Wrap(err, "error listing warden deployments")
+	}
+
+	var errs []string
+	found := make(map[string]bool)
+	for _, dep := range list.Items {
+		addr := dep.Annotations[labelAddress]
+		d, ok := want[addr]
+		if !ok {
+			log.Printf("removing deployment '%s' as it is no longer deployed", dep.Name)
+			if err := m.StopInstance(deploymentFromLabels(dep.Annotations)); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if current := deploymentFromLabels(dep.Annotations); current.sameAs(d) {
+			found[addr] = true
+			if route := m.serviceRoute(dep.Name); m.routes.Get(addr) != route {
+				m.routes.Set(addr, route)
+			}
+		}
+	}
+
+	for addr, d := range want {
+		if found[addr] {
+			continue
+		}
+		if err := m.DeployInstance(d); err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not reconcile '%s'", d.key()).Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Rebuilds the routes from the Deployments created by warden
+func (m *kubernetesManager) loadRoutes() error {
+	list, err := m.cli.AppsV1().Deployments(m.namespace).List(metav1.ListOptions{LabelSelector: labelName})
+	if err != nil {
+		return errors.Wrap(err, "error listing warden deployments")
+	}
+
+	for _, dep := range list.Items {
+		if addr, ok := dep.Annotations[labelAddress]; ok {
+			m.routes.Set(addr, m.serviceRoute(dep.Name))
+		}
+	}
+	return nil
+}
+
+// Gets the address the Service is reached at from within the cluster
+func (m *kubernetesManager) serviceRoute(name string) string {
+	return fmt.Sprintf("%s.%s.svc:%d", name, m.namespace, m.port)
+}
+
+// Gets the Deployment running the deployment's pods. Updates are rolled out by
+// surging a new pod at a time and only taking an old pod down once the new one is
+// ready, so the address keeps being served while it moves to another commit
+func (m *kubernetesManager) deploymentSpec(d Deployment) *appsv1.Deployment {
+	replicas := int32(d.MinReplica)
+	selector := map[string]string{labelName: d.AddressName()}
+	meta := m.objectMeta(d)
+	maxUnavailable, maxSurge := intstr.FromInt(0), intstr.FromInt(1)
+
+	return &appsv1.Deployment{
+		ObjectMeta: meta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{
+					MaxUnavailable: &maxUnavailable,
+					MaxSurge:       &maxSurge,
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: meta.Labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:           "instance",
+						Image:          d.ImageName(),
+						Ports:          []corev1.ContainerPort{{ContainerPort: m.port}},
+						Env:            podEnv(d),
+						ReadinessProbe: m.podProbe(m.readiness),
+						LivenessProbe:  m.livenessProbe(),
+						Resources:      podResources(m.limits.apply(d)),
+					}},
+				},
+			},
+		},
+	}
+}
+
+// Converts the probe to one run by the kubelet on the instance's port
+func (m *kubernetesManager) podProbe(p probe) *corev1.Probe {
+	handler := corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(int(m.port))}}
+	if p.path != "" {
+		handler = corev1.Handler{HTTPGet: &corev1.HTTPGetAction{
+			Path: "/" + strings.TrimPrefix(p.path, "/"),
+			Port: intstr.FromInt(int(m.port)),
+		}}
+	}
+
+	kp := &corev1.Probe{Handler: handler, FailureThreshold: int32(p.failures)}
+	if p.timeout > 0 {
+		kp.TimeoutSeconds = int32(math.Ceil(p.timeout.Seconds()))
+	}
+	if p.interval > 0 {
+		kp.PeriodSeconds = int32(math.Ceil(p.interval.Seconds()))
+	}
+	return kp
+}
+
+// Gets the liveness probe of the pods. There is none if the probe's interval is 0
+func (m *kubernetesManager) livenessProbe() *corev1.Probe {
+	if m.liveness.interval <= 0 {
+		return nil
+	}
+	return m.podProbe(m.liveness)
+}
+
+func (m *kubernetesManager) serviceSpec(d Deployment) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: m.objectMeta(d),
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{labelName: d.AddressName()},
+			Ports: []corev1.ServicePort{{
+				Port:       m.port,
+				TargetPort: intstr.FromInt(int(m.port)),
+			}},
+		},
+	}
+}
+
+// Gets the container's environment variables. Their values are read from the
+// deployment's Secret
+func podEnv(d Deployment) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, name := range d.envNames() {
+		env = append(env, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName(d)},
+				Key:                  name,
+			}},
+		})
+	}
+	return env
+}
+
+// Gets the name of the Secret holding the deployment's environment variables. Each
+// deployment has its own so that pods being rolled over keep their values
+func secretName(d Deployment) string {
+	return d.ServiceName()
+}
+
+// Gets the name of the Secret the Deployment's pods read their environment from, if
+// any
+func podSecret(dep *appsv1.Deployment) string {
+	for _, c := range dep.Spec.Template.Spec.Containers {
+		for _, e := range c.Env {
+			if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil {
+				return e.ValueFrom.SecretKeyRef.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Creates or updates the Secret holding the deployment's environment variables. No
+// Secret is needed if the deployment has none
+func (m *kubernetesManager) applySecret(d Deployment) error {
+	if len(d.Env) == 0 {
+		return nil
+	}
+
+	meta := m.objectMeta(d)
+	meta.Name = secretName(d)
+	secret := &corev1.Secret{ObjectMeta: meta, Type: corev1.SecretTypeOpaque, Data: make(map[string][]byte)}
+	for name, value := range d.Env {
+		secret.Data[name] = []byte(value)
+	}
+
+	secrets := m.cli.CoreV1().Secrets(m.namespace)
+	existing, err := secrets.Get(secret.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = secrets.Create(secret)
+	case err == nil:
+		secret.ResourceVersion = existing.ResourceVersion
+		_, err = secrets.Update(secret)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not store environment of instance: %s", secret.Name)
+	}
+	return nil
+}
+
+// Removes the Secrets of the deployment's address other than the ones kept
+func (m *kubernetesManager) pruneSecrets(d Deployment, keep ...string) error {
+	secrets := m.cli.CoreV1().Secrets(m.namespace)
+	list, err := secrets.List(metav1.ListOptions{LabelSelector: labelName + "=" + d.AddressName()})
+	if err != nil {
+		return errors.Wrapf(err, "error listing secrets of: %s", d.AddressName())
+	}
+
+	for _, secret := range list.Items {
+		if utils.StrIsIn(secret.Name, keep) {
+			continue
+		}
+		if err := secrets.Delete(secret.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error removing secret: %s", secret.Name)
+		}
+	}
+	return nil
+}
+
+// Converts the limits to the container's resource requirements. CPU shares are
+// requested as the equivalent fraction of a CPU, without exceeding the CPU limit. The
+// pod spec has no pids or open files limits, those are left to the nodes' settings
+func podResources(r model.Resources) corev1.ResourceRequirements {
+	var res corev1.ResourceRequirements
+	limits := corev1.ResourceList{}
+	if r.Memory > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(r.Memory, resource.BinarySI)
+	}
+	if r.CPUQuota > 0 {
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(r.CPUQuota*1000/cpuPeriod, resource.DecimalSI)
+	}
+	if len(limits) > 0 {
+		res.Limits = limits
+	}
+
+	if r.CPUShares > 0 {
+		millis := r.CPUShares * 1000 / 1024
+		if r.CPUQuota > 0 && millis > r.CPUQuota*1000/cpuPeriod {
+			millis = r.CPUQuota * 1000 / cpuPeriod
+		}
+		if millis < 1 {
+			millis = 1
+		}
+		res.Requests = corev1.ResourceList{corev1.ResourceCPU: *resource.NewMilliQuantity(millis, resource.DecimalSI)}
+	}
+	return res
+}
+
+// Kubernetes label values are restricted, so values that may not fit such as the
+// address are kept as annotations instead
+func (m *kubernetesManager) objectMeta(d Deployment) metav1.ObjectMeta {
+	labels := map[string]string{labelName: d.AddressName()}
+	annotations := make(map[string]string)
+	for k, v := range d.labels() {
+		annotations[k] = v
+		switch k {
+		case labelInstance, labelDeployment, labelProject, labelAlias, labelCommit:
+			labels[k] = kubeLabelValue(v)
+		}
+	}
+
+	return metav1.ObjectMeta{
+		Name:        d.AddressName(),
+		Namespace:   m.namespace,
+		Labels:      labels,
+		Annotations: annotations,
+	}
+}
+
+// Converts the value into a valid Kubernetes label value (alphanumerics, '-', '_'
+// and '.', at most 63 characters, starting and ending with an alphanumeric)
+func kubeLabelValue(value string) string {
+	value = invalidNameChars.ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+func newKubernetesManager() (*kubernetesManager, error) {
+	var config *rest.Config
+	var err error
+	if path := strings.TrimSpace(viper.GetString("deploy.kubeconfig")); path != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", path)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading Kubernetes config")
+	}
+
+	cli, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating new Kubernetes Client")
+	}
+
+	namespace := utils.StrLowerTrim(viper.GetString("deploy.namespace"))
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	port := viper.GetInt("deploy.port")
+	if port <= 0 || port > 65535 {
+		return nil, errors.Errorf("deploy.port must be a valid port that the instances listen on, got %d", port)
+	}
+
+	limits, err := resourceLimitsFromViper()
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.requireNoProcessLimits("kubernetes"); err != nil {
+		return nil, err
+	}
+
+	m := &kubernetesManager{
+		routes:    newRouteMap(),
+		client:    newInstanceClient(transportConfigFromViper()),
+		ctx:       context.Background(),
+		cli:       cli,
+		namespace: namespace,
+		port:      int32(port),
+		readiness: probeFromViper("deploy.readiness"),
+		liveness:  probeFromViper("deploy.liveness"),
+		limits:    limits,
+	}
+	m.waitReady = m.readiness.waitReady
+	m.waitRollout = m.rollout
+	if err := m.loadRoutes(); err != nil {
+		log.Println(err)
+	}
+	return m, nil
+}
@@ -0,0 +1,199 @@
+package deploy
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"warden/store/model"
+)
+
+func newFakeKubernetesManager() *kubernetesManager {
+	return &kubernetesManager{
+		routes:    newRouteMap(),
+		ctx:       context.Background(),
+		cli:       fake.NewSimpleClientset(),
+		namespace: "warden",
+		port:      8080,
+		readiness: probe{path: "/healthz", timeout: time.Second, failures: 3},
+		liveness:  probe{interval: 10 * time.Second, failures: 3},
+		limits:    resourceLimits{max: model.Resources{Memory: 1 << 30}},
+
+		waitReady:   func(string) error { return nil },
+		waitRollout: func(string, int64) error { return nil },
+	}
+}
+
+func TestKubernetesManager_DeployInstance(t *testing.T) {
+	m := newFakeKubernetesManager()
+
+	d := Deployment{Project: "proj", Alias: "dev", Hash: "abc123", MinReplica: 2, MaxReplica: 5}
+	d.Resources = model.Resources{CPUShares: 512, CPUQuota: 50000}
+	d.Env = map[string]string{"LOG_LEVEL": "debug"}
+	assert.Nil(t, m.DeployInstance(d))
+
+	dep, err := m.cli.AppsV1().Deployments("warden").Get("warden-proj-dev", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), *dep.Spec.Replicas)
+	assert.Equal(t, "5", dep.Annotations[labelMaxReplica])
+	assert.Equal(t, "proj/dev", dep.Annotations[labelAddress])
+	assert.Equal(t, "abc123", dep.Labels[labelCommit])
+	assert.Equal(t, d.ImageName(), dep.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "/healthz", dep.Spec.Template.Spec.Containers[0].ReadinessProbe.HTTPGet.Path)
+	assert.Equal(t, int32(1), dep.Spec.Template.Spec.Containers[0].ReadinessProbe.TimeoutSeconds)
+	assert.Equal(t, 8080, dep.Spec.Template.Spec.Containers[0].LivenessProbe.TCPSocket.Port.IntValue())
+	assert.Equal(t, int32(10), dep.Spec.Template.Spec.Containers[0].LivenessProbe.PeriodSeconds)
+	assert.Equal(t, "LOG_LEVEL", dep.Spec.Template.Spec.Containers[0].Env[0].Name)
+	assert.Equal(t, "", dep.Spec.Template.Spec.Containers[0].Env[0].Value)
+	assert.Equal(t, "warden-proj-dev-abc123", dep.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, "LOG_LEVEL", dep.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Key)
+	assert.Equal(t, "1Gi", dep.Spec.Template.Spec.Containers[0].Resources.Limits.Memory().String())
+	assert.Equal(t, "500m", dep.Spec.Template.Spec.Containers[0].Resources.Limits.Cpu().String())
+	assert.Equal(t, "500m", dep.Spec.Template.Spec.Containers[0].Resources.Requests.Cpu().String())
+
+	secret, err := m.cli.CoreV1().Secrets("warden").Get("warden-proj-dev-abc123", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("debug"), secret.Data["LOG_LEVEL"])
+
+	svc, err := m.cli.CoreV1().Services("warden").Get("warden-proj-dev", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, dep.Spec.Selector.MatchLabels, svc.Spec.Selector)
+	assert.Equal(t, "warden-proj-dev.warden.svc:8080", m.routes.Get("proj/dev"))
+
+	// deploying another commit updates the deployment in place
+	d.Hash = "def456"
+	assert.Nil(t, m.DeployInstance(d))
+	dep, err = m.cli.AppsV1().Deployments("warden").Get("warden-proj-dev", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "def456", dep.Labels[labelCommit])
+	assert.Equal(t, d.ImageName(), dep.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, []string{"warden-proj-dev-abc123", "warden-proj-dev-def456"}, secretNames(t, m))
+
+	// the Secret of the pods rolled over by the previous update is removed
+	d.Hash = "789abc"
+	assert.Nil(t, m.DeployInstance(d))
+	assert.Equal(t, []string{"warden-proj-dev-789abc", "warden-proj-dev-def456"}, secretNames(t, m))
+
+	assert.Nil(t, m.StopInstance(d))
+	assert.Empty(t, secretNames(t, m))
+}
+
+func secretNames(t *testing.T, m *kubernetesManager) []string {
+	list, err := m.cli.CoreV1().Secrets("warden").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	var names []string
+	for _, secret := range list.Items {
+		names = append(names, secret.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestKubernetesManager_StopInstance(t *testing.T) {
+	m := newFakeKubernetesManager()
+
+	old := Deployment{Project: "proj", Hash: "abc123"}
+	replacement := Deployment{Project: "proj", Hash: "def456"}
+	assert.Nil(t, m.DeployInstance(old))
+	assert.Nil(t, m.DeployInstance(replacement))
+
+	// stopping the replaced commit leaves its successor running
+	assert.Nil(t, m.StopInstance(old))
+	_, err := m.cli.AppsV1().Deployments("warden").Get("warden-proj-latest", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "warden-proj-latest.warden.svc:8080", m.routes.Get("proj"))
+
+	assert.Nil(t, m.StopInstance(replacement))
+	_, err = m.cli.AppsV1().Deployments("warden").Get("warden-proj-latest", metav1.GetOptions{})
+	assert.NotNil(t, err)
+	_, err = m.cli.CoreV1().Services("warden").Get("warden-proj-latest", metav1.GetOptions{})
+	assert.NotNil(t, err)
+	assert.Equal(t, "", m.routes.Get("proj"))
+
+	// stopping a missing deployment does nothing
+	assert.Nil(t, m.StopInstance(replacement))
+}
+
+func TestKubernetesManager_LoadRoutes(t *testing.T) {
+	m := newFakeKubernetesManager()
+	assert.Nil(t, m.DeployInstance(Deployment{Project: "proj", Alias: "dev", Hash: "abc123"}))
+
+	m.routes = newRouteMap()
+	assert.Nil(t, m.loadRoutes())
+	assert.Equal(t, "warden-proj-dev.warden.svc:8080", m.routes.Get("proj/dev"))
+}
+
+func TestKubernetesManager_Reconcile(t *testing.T) {
+	m := newFakeKubernetesManager()
+
+	kept := Deployment{Project: "proj", Alias: "dev", Hash: "abc123"}
+	outdated := Deployment{Project: "proj", Hash: "abc123"}
+	stray := Deployment{Project: "proj", Alias: "old", Hash: "abc123"}
+	assert.Nil(t, m.DeployInstance(kept))
+	assert.Nil(t, m.DeployInstance(outdated))
+	assert.Nil(t, m.DeployInstance(stray))
+
+	updated := outdated
+	updated.Hash = "def456"
+	missing := Deployment{Project: "other", Hash: "def456"}
+
+	m.routes = newRouteMap()
+	assert.Nil(t, m.Reconcile([]Deployment{kept, updated, missing}))
+
+	list, err := m.cli.AppsV1().Deployments("warden").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	hashes := make(map[string]string)
+	for _, dep := range list.Items {
+		hashes[dep.Name] = dep.Labels[labelCommit]
+	}
+	assert.Equal(t, map[string]string{
+		"warden-proj-dev":     "abc123",
+		"warden-proj-latest":  "def456",
+		"warden-other-latest": "def456",
+	}, hashes)
+	assert.Equal(t, "warden-proj-dev.warden.svc:8080", m.routes.Get("proj/dev"))
+	assert.Equal(t, "warden-proj-latest.warden.svc:8080", m.routes.Get("proj"))
+	assert.Equal(t, "", m.routes.Get("proj/old"))
+}
+
+func TestKubernetesManager_LivenessDisabled(t *testing.T) {
+	m := newFakeKubernetesManager()
+	m.liveness.interval = 0
+	assert.Nil(t, m.DeployInstance(Deployment{Project: "proj", Hash: "abc123"}))
+
+	dep, err := m.cli.AppsV1().Deployments("warden").Get("warden-proj-latest", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, dep.Spec.Template.Spec.Containers[0].LivenessProbe)
+	assert.NotNil(t, dep.Spec.Template.Spec.Containers[0].ReadinessProbe)
+}
+
+func TestKubernetesManager_Rollout(t *testing.T) {
+	viper.Set("deploy.start_timeout", "100ms")
+	defer viper.Set("deploy.start_timeout", nil)
+
+	m := newFakeKubernetesManager()
+	assert.Nil(t, m.DeployInstance(Deployment{Project: "proj", Alias: "dev", Hash: "abc123", MinReplica: 2, MaxReplica: 2}))
+	deployments := m.cli.AppsV1().Deployments("warden")
+	dep, err := deployments.Get("warden-proj-dev", metav1.GetOptions{})
+	assert.Nil(t, err)
+	dep.Generation = 2
+
+	// the old pods are still running
+	dep.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 2, AvailableReplicas: 2}
+	_, err = deployments.Update(dep)
+	assert.Nil(t, err)
+	assert.EqualError(t, m.rollout("warden-proj-dev", 2), "deployment 'warden-proj-dev' was not rolled out within 100ms, 2 of 2 replicas updated and 2 available")
+
+	dep.Status.Replicas = 2
+	_, err = deployments.Update(dep)
+	assert.Nil(t, err)
+	assert.Nil(t, m.rollout("warden-proj-dev", 2))
+	assert.NotNil(t, m.rollout("warden-proj-dev", 3))
+}
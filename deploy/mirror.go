@@ -0,0 +1,291 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/viper"
+)
+
+// Receives the results of the mirrored requests. Results are dropped while it is full
+var mirrorResults = make(chan MirrorResult, 256)
+
+// Gets the results of the requests mirrored to shadow aliases. Each result compares
+// the response of the shadow alias to the response the caller received
+func MirrorResults() <-chan MirrorResult {
+	return mirrorResults
+}
+
+// The outcome of a request that was mirrored to a shadow alias
+type MirrorResult struct {
+	Project     string
+	Alias       string // alias the caller called
+	MirrorAlias string // shadow alias the copy was sent to
+	Method      string
+	Path        string
+	Time        time.Time // time the request was received
+	Primary     MirrorResponse
+	Shadow      MirrorResponse
+}
+
+// A response to a mirrored request. The body is summarized by its size and hash
+type MirrorResponse struct {
+	Status   int
+	BodySize int64
+	BodyHash string // hex encoded SHA-256 of the body
+	Latency  time.Duration
+	Error    string // reason there is no response, if any
+}
+
+// Settings of the mirroring
+type mirrorConfig struct {
+	maxBody int64         // requests with larger bodies are not mirrored
+	timeout time.Duration // time the shadow alias has to respond
+}
+
+// Sends a copy of each request to the shadow alias of the deployment serving its
+// address, if it has one, and reports how the shadow's response compares to the
+// caller's. The copy is sent in the background and its response is discarded, so the
+// caller's response is not affected by the shadow alias.
+//
+// The request body has to be buffered to be sent twice. Requests with bodies larger
+// than the max body are not mirrored
+type mirror struct {
+	mgr         Manager
+	config      mirrorConfig
+	m           sync.RWMutex
+	deployments map[string]Deployment // keyed by address
+	results     chan<- MirrorResult
+}
+
+// Deploys the instance and mirrors its requests to its shadow alias
+func (s *mirror) DeployInstance(d Deployment) error {
+	if err := s.mgr.DeployInstance(d); err != nil {
+		return err
+	}
+	_ = d.validate()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.deployments[d.Address()] = d
+	return nil
+}
+
+// Reconciles the underlying Manager, then mirrors the requests of the desired
+// deployments
+func (s *mirror) Reconcile(desired []Deployment) error {
+	err := s.mgr.Reconcile(desired)
+
+	deployments := make(map[string]Deployment)
+	for _, d := range desired {
+		_ = d.validate()
+		deployments[d.Address()] = d
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.deployments = deployments
+	return err
+}
+
+// Stops the instance. Its requests are no longer mirrored unless its address has
+// since been deployed with another commit
+func (s *mirror) StopInstance(d Deployment) error {
+	if err := s.mgr.StopInstance(d); err != nil {
+		return err
+	}
+	_ = d.validate()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if current, ok := s.deployments[d.Address()]; ok && current.sameAs(d) {
+		delete(s.deployments, d.Address())
+	}
+	return nil
+}
+
+func (s *mirror) ScaleInstance(d Deployment, replicas int) error {
+	return s.mgr.ScaleInstance(d, replicas)
+}
+
+// Runs the instance and mirrors the request to the shadow alias of its address
+func (s *mirror) RunInstance(r *http.Request) (*http.Response, error) {
+	payload, err := NewPayload(r)
+	if err != nil {
+		return s.mgr.RunInstance(r)
+	}
+
+	s.m.RLock()
+	d, ok := s.deployments[payload.Address()]
+	s.m.RUnlock()
+	if !ok || d.Mirror == "" || d.Mirror == d.aliasName() {
+		return s.mgr.RunInstance(r)
+	}
+
+	body, buffered, err := bufferBody(r, s.config.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	if !buffered {
+		return s.mgr.RunInstance(r)
+	}
+
+	result := MirrorResult{
+		Project:     d.Project,
+		Alias:       d.aliasName(),
+		MirrorAlias: d.Mirror,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Time:        time.Now(),
+	}
+	primary := make(chan MirrorResponse, 1)
+	go s.shadow(s.shadowRequest(r, d.Mirror, body), result, primary)
+
+	resp, err := s.mgr.RunInstance(r)
+	latency := time.Since(result.Time)
+	if err != nil {
+		primary <- MirrorResponse{Latency: latency, Error: err.Error()}
+		return nil, err
+	}
+	resp.Body = &hashingBody{
+		ReadCloser: resp.Body,
+		hash:       sha256.New(),
+		done: func(size int64, sum string) {
+			primary <- MirrorResponse{Status: resp.StatusCode, BodySize: size, BodyHash: sum, Latency: latency}
+		},
+	}
+	return resp, nil
+}
+
+func (s *mirror) Close() error {
+	return s.mgr.Close()
+}
+
+// Forms the copy of the request sent to the shadow alias. The copy is not cancelled
+// when the caller goes away, only once the shadow alias times out
+func (s *mirror) shadowRequest(r *http.Request, alias string, body []byte) *http.Request {
+	ctx := context.Background()
+	if rctx := r.Context().Value(chi.RouteCtxKey); rctx != nil {
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+	}
+	shadow := withAlias(r.WithContext(ctx), alias)
+
+	shadow.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		shadow.Header[k] = append([]string(nil), v...)
+	}
+	shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	return shadow
+}
+
+// Sends the copy of the request to the shadow alias and reports its response along
+// with the caller's once the caller's response is complete
+func (s *mirror) shadow(r *http.Request, result MirrorResult, primary <-chan MirrorResponse) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := s.mgr.RunInstance(r.WithContext(ctx))
+	result.Shadow.Latency = time.Since(start)
+	if err != nil {
+		result.Shadow.Error = err.Error()
+	} else {
+		h := sha256.New()
+		result.Shadow.Status = resp.StatusCode
+		result.Shadow.BodySize, err = io.Copy(h, resp.Body)
+		_ = resp.Body.Close()
+		result.Shadow.BodyHash = hex.EncodeToString(h.Sum(nil))
+		if err != nil {
+			result.Shadow.Error = err.Error()
+		}
+	}
+
+	result.Primary = <-primary
+	select {
+	case s.results <- result:
+	default:
+	}
+}
+
+// Reads the request's body so that it can be sent again. The request is left with
+// a body that reads the same. Returns false if the body is larger than the max, in
+// which case only part of it has been read
+func bufferBody(r *http.Request, max int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > max {
+		r.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		return nil, false, nil
+	}
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// A response body that hashes what is read from it and reports the hash once it is
+// closed
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	size int64
+	once sync.Once
+	done func(size int64, sum string)
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	_, _ = b.hash.Write(p[:n])
+	return n, err
+}
+
+func (b *hashingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.size, hex.EncodeToString(b.hash.Sum(nil))) })
+	return err
+}
+
+func newMirror(mgr Manager, config mirrorConfig) *mirror {
+	return &mirror{
+		mgr:         mgr,
+		config:      config,
+		deployments: make(map[string]Deployment),
+		results:     mirrorResults,
+	}
+}
+
+// Reads the mirroring settings from the config
+func mirrorConfigFromViper() mirrorConfig {
+	config := mirrorConfig{
+		maxBody: int64(viper.GetSizeInBytes("deploy.mirror.max_body")),
+		timeout: viper.GetDuration("deploy.mirror.timeout"),
+	}
+	if !viper.IsSet("deploy.mirror.max_body") {
+		config.maxBody = 1 << 20
+	}
+	if config.timeout <= 0 {
+		config.timeout = 30 * time.Second
+	}
+	return config
+}
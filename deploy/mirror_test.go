@@ -0,0 +1,108 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A Manager that echoes the body of each request along with the address it was run on
+type echoManager struct {
+	*fakeManager
+	m      sync.Mutex
+	bodies map[string]string // last body received by each address
+}
+
+func (f *echoManager) RunInstance(r *http.Request) (*http.Response, error) {
+	payload, err := NewPayload(r)
+	if err != nil {
+		return nil, err
+	}
+	body := ""
+	if r.Body != nil {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}
+
+	f.m.Lock()
+	f.bodies[payload.Address()] = body
+	f.m.Unlock()
+
+	status := http.StatusOK
+	if payload.Address() == "proj/shadow" {
+		status = http.StatusInternalServerError
+	}
+	return &http.Response{StatusCode: status, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func newFakeMirror(t *testing.T, maxBody int64) (*mirror, *echoManager, chan MirrorResult) {
+	mgr := &echoManager{
+		fakeManager: &fakeManager{clock: &fakeClock{t: time.Unix(0, 0)}, replicas: make(map[string]int)},
+		bodies:      make(map[string]string),
+	}
+	results := make(chan MirrorResult, 1)
+	m := newMirror(mgr, mirrorConfig{maxBody: maxBody, timeout: time.Second})
+	m.results = results
+	assert.Nil(t, m.DeployInstance(Deployment{Project: "proj", Hash: "abc", Mirror: "Shadow"}))
+	return m, mgr, results
+}
+
+func newExecPost(body string) *http.Request {
+	r := newExecRequest("proj", "latest")
+	r.Method = "POST"
+	r.Body = ioutil.NopCloser(strings.NewReader(body))
+	return r
+}
+
+func TestMirror_RunInstance(t *testing.T) {
+	m, mgr, results := newFakeMirror(t, 16)
+
+	resp, err := m.RunInstance(newExecPost("hello"))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, resp.Body.Close())
+	assert.Equal(t, "hello", string(body))
+
+	select {
+	case r := <-results:
+		assert.Equal(t, "latest", r.Alias)
+		assert.Equal(t, "shadow", r.MirrorAlias)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, http.StatusOK, r.Primary.Status)
+		assert.Equal(t, http.StatusInternalServerError, r.Shadow.Status)
+		assert.Equal(t, int64(5), r.Primary.BodySize)
+		assert.Equal(t, r.Primary.BodyHash, r.Shadow.BodyHash)
+	case <-time.After(time.Second):
+		t.Fatal("mirror result was not reported")
+	}
+
+	mgr.m.Lock()
+	assert.Equal(t, "hello", mgr.bodies["proj/shadow"])
+	mgr.m.Unlock()
+}
+
+func TestMirror_MaxBody(t *testing.T) {
+	m, mgr, results := newFakeMirror(t, 4)
+
+	resp, err := m.RunInstance(newExecPost("too large"))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, resp.Body.Close())
+	// the caller's instance still receives the whole body
+	assert.Equal(t, "too large", string(body))
+
+	select {
+	case <-results:
+		t.Fatal("request larger than the max body was mirrored")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mgr.m.Lock()
+	_, mirrored := mgr.bodies["proj/shadow"]
+	mgr.m.Unlock()
+	assert.False(t, mirrored)
+}
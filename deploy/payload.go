@@ -1,12 +1,12 @@
 package deploy
 
 import (
+	"context"
 	"io"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
@@ -18,12 +18,15 @@ import (
 // send the function call to. It is sent from the client and redirected
 // to the running instance with some modifications
 type Payload struct {
-	alias       string        // targeted project alias for request
-	body        io.ReadCloser // payload from the user that will be sent to the instance
-	headers     http.Header   // Request headers
-	method      string        // request method
-	project     string        // targeted project for request
-	queryValues url.Values    // Query values
+	alias    string          // targeted project alias for request
+	body     io.ReadCloser   // payload from the user that will be sent to the instance
+	ctx      context.Context // context of the client's request. Cancels the call if the client goes away
+	headers  http.Header     // Request headers
+	method   string          // request method
+	path     string          // path after the project and alias, forwarded to the instance
+	rawPath  string          // path as the client encoded it, if it differs from the default encoding
+	project  string          // targeted project for request
+	rawQuery string          // query string as the client sent it, without the '?'
 }
 
 // Generates the address of the project given the project name and alias.
@@ -39,64 +42,164 @@ func (p *Payload) Address() string {
 }
 
 // Executes the payload by running it through the Docker engine or Swarm/Kubernetes cluster
-// The host domain of the cluster needs to be specified
-func (p *Payload) Execute(host string) (*http.Response, error) {
-	jar, err := cookiejar.New(nil)
+// The host domain of the cluster needs to be specified. The client is shared with the
+// other payloads, so the caller's cookies are only sent as the payload's headers
+func (p *Payload) Execute(c *http.Client, host string) (*http.Response, error) {
+	addr, err := p.getUrl(host)
 	if err != nil {
-		return nil, errors.Wrap(err, "error running instance, failed creating cookie jar")
-	}
-
-	c := &http.Client{
-		Transport:     nil,
-		CheckRedirect: nil,
-		Jar:           jar,
-		Timeout:       5 * time.Minute,
+		return nil, err
 	}
-
-	req, err := http.NewRequest(p.method, p.getUrl(host), p.body)
+	req, err := http.NewRequest(p.method, addr, p.body)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(p.ctx)
 	req.Header = p.headers
 	return c.Do(req)
 }
 
 // Constructs the url to send the payload to. This url is the url to the
-// instance running in the Docker engine or Swarm/Kubernetes instance.
-func (p *Payload) getUrl(host string) string {
-	var addr strings.Builder
-
-	addr.WriteString(host)
-	if len(p.queryValues) > 0 {
-		addr.WriteString("?")
-		for k, v := range p.queryValues {
-			addr.WriteString(k + "=" + strings.Join(v, ","))
+// instance running in the Docker engine or Swarm/Kubernetes instance, followed
+// by the path the client called after the project and alias. The path and query
+// string are kept as the client encoded them.
+func (p *Payload) getUrl(host string) (string, error) {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid instance address '%s'", host)
+	}
+
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + "/" + strings.TrimPrefix(p.path, "/")
+	// url only uses the raw path if it is a valid encoding of the path
+	if p.rawPath != "" {
+		u.RawPath = (&url.URL{Path: base}).EscapedPath() + "/" + strings.TrimPrefix(p.rawPath, "/")
+	}
+	u.RawQuery = p.rawQuery
+	return u.String(), nil
+}
+
+// Forwards the request to one of the routes registered for its project and alias with
+// the client. Shared by the managers that keep their routes in a routeMap
+func runInstance(c *http.Client, routes *routeMap, r *http.Request) (*http.Response, error) {
+	payload, err := NewPayload(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "error forming payload")
+	}
+
+	addr := payload.Address()
+	u := routes.Acquire(addr)
+	if u == nil {
+		if routes.Has(addr) {
+			return nil, errors.Wrapf(ErrInstanceUnreachable, "every route for address '%s' was evicted", addr)
+		}
+		return nil, errors.Wrapf(ErrInstanceNotFound, "no route for address '%s'", addr)
+	}
+
+	resp, err := payload.Execute(c, u.route)
+	if err != nil {
+		// the upstream is not at fault when the client went away
+		if r.Context().Err() == context.Canceled {
+			routes.Release(addr, u, false)
+			return nil, errors.Wrapf(ErrRequestCancelled, "request to '%s' cancelled", addr)
 		}
+		err = instanceError(err, addr)
+		routes.Release(addr, u, errors.Cause(err) == ErrInstanceUnreachable)
+		return nil, err
+	}
+	// the request is in flight until its response is read, so that stopping the
+	// upstream waits for the response to be sent back
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { routes.Release(addr, u, false) }}
+	return resp, nil
+}
+
+// A response body that releases its upstream once it is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Hop-by-hop headers. These are only meaningful for a single connection and are not
+// forwarded between the client and the instance
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Removes the hop-by-hop headers, along with the ones the Connection header names
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
 	}
-	return addr.String()
+}
+
+// Gets a copy of the client's headers to send to the instance. The client's request
+// is left untouched as it may be forwarded again
+func forwardedHeaders(h http.Header) http.Header {
+	headers := make(http.Header, len(h))
+	for k, v := range h {
+		headers[k] = append([]string(nil), v...)
+	}
+	RemoveHopHeaders(headers)
+	return headers
 }
 
 // Creates a new payload object from the client's request
 func NewPayload(r *http.Request) (*Payload, error) {
 	p := &Payload{
-		project:     utils.StrLowerTrim(chi.URLParam(r, "project")),
-		alias:       utils.StrLowerTrim(chi.URLParam(r, "alias")),
-		headers:     r.Header,
-		queryValues: r.URL.Query(),
+		project:  utils.StrLowerTrim(chi.URLParam(r, "project")),
+		alias:    utils.StrLowerTrim(chi.URLParam(r, "alias")),
+		ctx:      r.Context(),
+		headers:  forwardedHeaders(r.Header),
+		rawQuery: r.URL.RawQuery,
+	}
+
+	// the router matches the escaped path when the client's encoding differs from
+	// the default one
+	p.path = chi.URLParam(r, "*")
+	if r.URL.RawPath != "" {
+		p.rawPath = p.path
+		path, err := url.PathUnescape(p.rawPath)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidRequest, "invalid request path: %s", err)
+		}
+		p.path = path
 	}
 
 	if p.alias == "latest" {
 		p.alias = ""
 	}
-	switch strings.ToUpper(r.Method) {
-	case "GET":
-		p.method = "GET"
+	p.method = strings.ToUpper(r.Method)
+	switch p.method {
+	case http.MethodGet, http.MethodHead:
 		p.body = nil
-	case "POST":
-		p.method = "POST"
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
 		p.body = r.Body
 	default:
-		return nil, errors.Errorf("Only GET and POST method are allowed")
+		return nil, errors.Wrapf(ErrMethodNotAllowed, "method %s is not allowed", r.Method)
 	}
 
 	return p, nil
@@ -0,0 +1,130 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPayload(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		r := newExecRequest("proj", "dev")
+		r.Method = method
+		r.Body = http.NoBody
+		p, err := NewPayload(r)
+		assert.Nil(t, err, method)
+		assert.Equal(t, method, p.method)
+		assert.Equal(t, method != "GET" && method != "HEAD", p.body != nil, method)
+	}
+
+	r := newExecRequest("proj", "dev")
+	r.Method = "TRACE"
+	_, err := NewPayload(r)
+	assert.Equal(t, ErrMethodNotAllowed, errors.Cause(err))
+}
+
+func TestPayload_GetUrl(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string // url the client called
+		host   string // address of the instance
+		want   string
+	}{
+		{"no path", "/e/proj/dev", "10.0.0.1:8080", "http://10.0.0.1:8080/"},
+		{"sub-path", "/e/proj/dev/users/42", "10.0.0.1:8080", "http://10.0.0.1:8080/users/42"},
+		{"scheme and host", "/e/proj/dev/users", "http://warden-proj-dev:8080", "http://warden-proj-dev:8080/users"},
+		{"repeated keys", "/e/proj/dev?a=1&a=2&b=3", "10.0.0.1:8080", "http://10.0.0.1:8080/?a=1&a=2&b=3"},
+		{"comma in value", "/e/proj/dev?ids=1,2&ids=3", "10.0.0.1:8080", "http://10.0.0.1:8080/?ids=1,2&ids=3"},
+		{"unicode", "/e/proj/dev/caf%C3%A9?q=%E2%9C%93&name=%E6%97%A5%E6%9C%AC", "10.0.0.1:8080", "http://10.0.0.1:8080/caf%C3%A9?q=%E2%9C%93&name=%E6%97%A5%E6%9C%AC"},
+		{"reserved characters", "/e/proj/dev?next=https%3A%2F%2Fx.io%2F%3Fa%3D1%26b%3D2&q=a+b&empty=&flag", "10.0.0.1:8080", "http://10.0.0.1:8080/?next=https%3A%2F%2Fx.io%2F%3Fa%3D1%26b%3D2&q=a+b&empty=&flag"},
+		{"key order", "/e/proj/dev?z=1&a=2&m=3", "10.0.0.1:8080", "http://10.0.0.1:8080/?z=1&a=2&m=3"},
+		{"encoded slash in path", "/e/proj/dev/files/a%2Fb", "10.0.0.1:8080", "http://10.0.0.1:8080/files/a%2Fb"},
+		{"space in path", "/e/proj/dev/my%20file", "10.0.0.1:8080", "http://10.0.0.1:8080/my%20file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p *Payload
+			router := chi.NewRouter()
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				p, err = NewPayload(r)
+				assert.Nil(t, err)
+			}
+			router.HandleFunc("/e/{project}/{alias}", handler)
+			router.HandleFunc("/e/{project}/{alias}/*", handler)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.target, nil))
+
+			if assert.NotNil(t, p) {
+				assert.Equal(t, "proj/dev", p.Address())
+				got, err := p.getUrl(tt.host)
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewPayload_HopHeaders(t *testing.T) {
+	r := newExecRequest("proj", "dev")
+	r.Header.Set("Connection", "keep-alive, X-Hop")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Proxy-Authorization", "Basic abc")
+	r.Header.Set("Te", "trailers")
+	r.Header.Set("X-Hop", "1")
+	r.Header.Set("X-Request-Id", "42")
+
+	p, err := NewPayload(r)
+	assert.Nil(t, err)
+	assert.Equal(t, http.Header{"X-Request-Id": {"42"}}, p.headers)
+	// the client's request keeps its headers
+	assert.Equal(t, "1", r.Header.Get("X-Hop"))
+}
+
+func TestRunInstance_Cancelled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	routes := newRouteMap()
+	routes.evictAfter = 1
+	routes.Set("proj/dev", strings.TrimPrefix(srv.URL, "http://"))
+
+	r := newExecRequest("proj", "dev")
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := runInstance(srv.Client(), routes, r)
+	assert.Equal(t, ErrRequestCancelled, errors.Cause(err))
+	// the upstream is kept as it was not at fault
+	assert.Equal(t, []string{strings.TrimPrefix(srv.URL, "http://")}, routes.Routes("proj/dev"))
+}
+
+func TestRunInstance_Redirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login?next=%2Fhome", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	routes := newRouteMap()
+	routes.Set("proj/dev", strings.TrimPrefix(srv.URL, "http://"))
+
+	// the redirect is passed back to the caller rather than followed
+	resp, err := runInstance(newInstanceClient(transportConfigFromViper()), routes, newExecRequest("proj", "dev"))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login?next=%2Fhome", resp.Header.Get("Location"))
+}
@@ -0,0 +1,77 @@
+package deploy
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Assigns the host ports that the Docker manager publishes its containers on. A port
+// is only handed out if it isn't assigned to another container and can actually be
+// bound, so two deployments never race to the same port. Ports are assigned until
+// they are released when their container is removed
+type portAllocator struct {
+	m        sync.Mutex
+	min, max int // range of ports that can be assigned, max excluded
+	next     int // port to try first, so that released ports aren't reused right away
+	assigned map[int]bool
+	bind     func(port int) error // checks that nothing else listens on the port
+}
+
+// Assigns a free port in the allocator's range
+func (p *portAllocator) Allocate() (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for i := 0; i < p.max-p.min; i++ {
+		port := p.min + (p.next-p.min+i)%(p.max-p.min)
+		if p.assigned[port] {
+			continue
+		}
+		if err := p.bind(port); err != nil {
+			continue
+		}
+		p.assigned[port] = true
+		p.next = port + 1
+		return port, nil
+	}
+	return 0, errors.Errorf("unable to find free ports between %d and %d", p.min, p.max-1)
+}
+
+// Marks the port as assigned, i.e. to a container that was already running
+func (p *portAllocator) Reserve(port int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.assigned[port] = true
+}
+
+// Makes the port available to be assigned again
+func (p *portAllocator) Release(port int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	delete(p.assigned, port)
+}
+
+func newPortAllocator(min, max int) *portAllocator {
+	return &portAllocator{
+		min:      min,
+		max:      max,
+		next:     min,
+		assigned: make(map[int]bool),
+		bind:     bindPort,
+	}
+}
+
+// Binds the port on the address the containers are published on, then closes it right
+// away
+func bindPort(port int) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(localIP, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
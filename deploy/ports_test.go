@@ -0,0 +1,78 @@
+package deploy
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortAllocator_Allocate(t *testing.T) {
+	p := newPortAllocator(40000, 40003)
+	bound := map[int]bool{40001: true}
+	p.bind = func(port int) error {
+		if bound[port] {
+			return errors.New("address already in use")
+		}
+		return nil
+	}
+
+	port, err := p.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, 40000, port)
+
+	// ports that can't be bound are skipped
+	port, err = p.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, 40002, port)
+
+	_, err = p.Allocate()
+	assert.NotNil(t, err)
+
+	// released ports can be assigned again
+	p.Release(40000)
+	port, err = p.Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, 40000, port)
+
+	p.Release(40002)
+	p.Reserve(40002)
+	_, err = p.Allocate()
+	assert.NotNil(t, err)
+}
+
+func TestPortAllocator_Concurrent(t *testing.T) {
+	p := newPortAllocator(40000, 40100)
+	p.bind = func(int) error { return nil }
+
+	var wg sync.WaitGroup
+	ports := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port, err := p.Allocate()
+			assert.Nil(t, err)
+			ports <- port
+		}()
+	}
+	wg.Wait()
+	close(ports)
+
+	seen := make(map[int]bool)
+	for port := range ports {
+		assert.False(t, seen[port], "port %d assigned twice", port)
+		seen[port] = true
+	}
+	assert.Len(t, seen, 100)
+}
+
+func TestBindPort(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	assert.NotNil(t, bindPort(l.Addr().(*net.TCPAddr).Port))
+}
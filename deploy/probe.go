@@ -0,0 +1,115 @@
+package deploy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Time a TCP probe waits for the instance to hang up on the connection
+const tcpProbeSettle = 100 * time.Millisecond
+
+// Checks the health of an instance, either with a HTTP GET on the path or with a TCP
+// connect when no path is set. A TCP connection that the instance closes right away
+// fails the check, as Docker's proxy accepts connections to a published port even
+// when nothing listens in the container. Readiness probes must pass before an instance is
+// routed to, liveness probes take instances that fail too many times in a row out of
+// the route so that they can be restarted
+type probe struct {
+	path     string        // HTTP path to GET. Responses with status below 400 pass
+	timeout  time.Duration // time each check has to pass
+	interval time.Duration // time between each check
+	failures int           // consecutive failed checks before an instance is unhealthy
+}
+
+// Checks the instance at the route once
+func (p probe) check(route string) error {
+	timeout := p.timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	if p.path == "" {
+		return checkConn(route, timeout)
+	}
+
+	c := &http.Client{Timeout: timeout}
+	resp, err := c.Get(fmt.Sprintf("http://%s/%s", route, strings.TrimPrefix(p.path, "/")))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("probe of '%s' returned status %d", p.path, resp.StatusCode)
+	}
+	return nil
+}
+
+// Connects to the route and waits briefly for the instance to hang up. The instance is
+// listening if the connection stays open or it sends data
+func checkConn(route string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", route, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	settle := timeout
+	if settle > tcpProbeSettle {
+		settle = tcpProbeSettle
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(settle)); err != nil {
+		return err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return errors.Wrapf(err, "connection to '%s' was closed", route)
+	}
+	return nil
+}
+
+// Waits until the instance at the route passes the probe or the start timeout
+// (deploy.start_timeout) passes
+func (p probe) waitReady(route string) error {
+	timeout := viper.GetDuration("deploy.start_timeout")
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	interval := p.interval
+	if interval <= 0 || interval > time.Second {
+		interval = 200 * time.Millisecond
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := p.check(route)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "instance at '%s' was not ready within %s", route, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Reads the probe settings under the key (i.e. deploy.readiness)
+func probeFromViper(key string) probe {
+	p := probe{
+		path:     strings.TrimSpace(viper.GetString(key + ".path")),
+		timeout:  viper.GetDuration(key + ".timeout"),
+		interval: viper.GetDuration(key + ".interval"),
+		failures: viper.GetInt(key + ".failures"),
+	}
+	if p.failures <= 0 {
+		p.failures = 3
+	}
+	return p
+}
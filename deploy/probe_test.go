@@ -0,0 +1,74 @@
+package deploy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe_Check(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	route := strings.TrimPrefix(srv.URL, "http://")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadRoute := l.Addr().String()
+	l.Close()
+
+	// accepts connections then hangs up, like Docker's proxy when the container isn't listening
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer proxy.Close()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	assert.Nil(t, probe{}.check(route))
+	assert.NotNil(t, probe{}.check(deadRoute))
+	assert.NotNil(t, probe{}.check(proxy.Addr().String()))
+	assert.Nil(t, probe{path: "/healthz"}.check(route))
+	assert.Nil(t, probe{path: "healthz"}.check(route))
+	assert.EqualError(t, probe{path: "/other"}.check(route), "probe of '/other' returned status 503")
+	assert.NotNil(t, probe{path: "/healthz"}.check(deadRoute))
+}
+
+func TestProbe_WaitReady(t *testing.T) {
+	viper.Set("deploy.start_timeout", "300ms")
+	defer viper.Set("deploy.start_timeout", nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	route := l.Addr().String()
+	l.Close()
+
+	p := probe{interval: 50 * time.Millisecond}
+	assert.NotNil(t, p.waitReady(route))
+
+	// the instance starts listening after a while
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", route)
+		if err == nil {
+			defer l.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	assert.Nil(t, p.waitReady(route))
+}
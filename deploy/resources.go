@@ -0,0 +1,69 @@
+package deploy
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"warden/store/model"
+)
+
+// Period of the CPU quota. Quotas are in microseconds per period
+const cpuPeriod = 100000
+
+// The server-wide resource limits. Limits the deployment leaves at 0 take the default
+// and limits above the max are lowered to it
+type resourceLimits struct {
+	defaults model.Resources
+	max      model.Resources
+}
+
+// Gets the limits that the deployment's replicas run with
+func (l resourceLimits) apply(d Deployment) model.Resources {
+	return l.defaults.Merge(d.Resources).Cap(l.max)
+}
+
+// Reads the server-wide resource limits from the config
+func resourceLimitsFromViper() (resourceLimits, error) {
+	read := func(key string) model.Resources {
+		return model.Resources{
+			Memory:       int64(viper.GetSizeInBytes(key + ".memory")),
+			CPUShares:    viper.GetInt64(key + ".cpu_shares"),
+			CPUQuota:     viper.GetInt64(key + ".cpu_quota"),
+			PidsLimit:    viper.GetInt64(key + ".pids_limit"),
+			MaxOpenFiles: viper.GetInt64(key + ".max_open_files"),
+		}
+	}
+
+	l := resourceLimits{
+		defaults: read("deploy.resources.default"),
+		max:      read("deploy.resources.max"),
+	}
+	if err := l.defaults.Validate(); err != nil {
+		return l, errors.Wrap(err, "invalid deploy.resources.default")
+	}
+	if err := l.max.Validate(); err != nil {
+		return l, errors.Wrap(err, "invalid deploy.resources.max")
+	}
+	return l, nil
+}
+
+// Returns an error if the server-wide limits include the pids or open files limits,
+// which the cluster cannot apply to the replicas
+func (l resourceLimits) requireNoProcessLimits(cluster string) error {
+	for key, r := range map[string]model.Resources{"deploy.resources.default": l.defaults, "deploy.resources.max": l.max} {
+		if r.PidsLimit != 0 || r.MaxOpenFiles != 0 {
+			return errors.Errorf("%s cannot set pids_limit or max_open_files as %s does not apply them", key, cluster)
+		}
+	}
+	return nil
+}
+
+// Logs a warning if the project or instance of the deployment sets the pids or open
+// files limits, which the cluster cannot apply to the replicas
+func warnProcessLimits(d Deployment, cluster string) {
+	if d.Resources.PidsLimit != 0 || d.Resources.MaxOpenFiles != 0 {
+		log.Printf("'%s' sets pids_limit or max_open_files, which %s does not apply", d.key(), cluster)
+	}
+}
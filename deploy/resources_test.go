@@ -0,0 +1,66 @@
+package deploy
+
+import (
+	"testing"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
+)
+
+func TestResourceLimits(t *testing.T) {
+	viper.Set("deploy.resources.default.memory", "256MB")
+	viper.Set("deploy.resources.default.pids_limit", 100)
+	viper.Set("deploy.resources.max.memory", "1GB")
+	viper.Set("deploy.resources.max.cpu_quota", 200000)
+	defer viper.Set("deploy.resources", nil)
+
+	l, err := resourceLimitsFromViper()
+	assert.Nil(t, err)
+
+	// defaults fill the limits left at 0 and the max caps the rest
+	d := Deployment{Resources: model.Resources{CPUShares: 512, CPUQuota: 400000}}
+	assert.Equal(t, model.Resources{Memory: 256 << 20, CPUShares: 512, CPUQuota: 200000, PidsLimit: 100}, l.apply(d))
+
+	d.Resources = model.Resources{Memory: 2 << 30, PidsLimit: 50}
+	assert.Equal(t, model.Resources{Memory: 1 << 30, CPUQuota: 200000, PidsLimit: 50}, l.apply(d))
+
+	viper.Set("deploy.resources.max.cpu_quota", -1)
+	_, err = resourceLimitsFromViper()
+	assert.EqualError(t, err, "invalid deploy.resources.max: resource limits cannot be negative")
+}
+
+func TestResourceLimits_RequireNoProcessLimits(t *testing.T) {
+	l := resourceLimits{defaults: model.Resources{Memory: 1 << 28}, max: model.Resources{CPUQuota: 100000}}
+	assert.Nil(t, l.requireNoProcessLimits("swarm"))
+
+	l.max.MaxOpenFiles = 1024
+	assert.EqualError(t, l.requireNoProcessLimits("swarm"), "deploy.resources.max cannot set pids_limit or max_open_files as swarm does not apply them")
+
+	l.max.MaxOpenFiles = 0
+	l.defaults.PidsLimit = 64
+	assert.EqualError(t, l.requireNoProcessLimits("kubernetes"), "deploy.resources.default cannot set pids_limit or max_open_files as kubernetes does not apply them")
+}
+
+func TestContainerResources(t *testing.T) {
+	res := containerResources(model.Resources{Memory: 1 << 28, CPUShares: 512, CPUQuota: 50000, PidsLimit: 64, MaxOpenFiles: 1024})
+	assert.Equal(t, int64(1<<28), res.Memory)
+	assert.Equal(t, int64(512), res.CPUShares)
+	assert.Equal(t, int64(50000), res.CPUQuota)
+	assert.Equal(t, int64(cpuPeriod), res.CPUPeriod)
+	assert.Equal(t, int64(64), res.PidsLimit)
+	assert.Equal(t, []*units.Ulimit{{Name: "nofile", Soft: 1024, Hard: 1024}}, res.Ulimits)
+
+	assert.Equal(t, int64(0), containerResources(model.Resources{}).CPUPeriod)
+	assert.Nil(t, containerResources(model.Resources{}).Ulimits)
+}
+
+func TestServiceResources(t *testing.T) {
+	assert.Nil(t, serviceResources(model.Resources{CPUShares: 512}))
+
+	res := serviceResources(model.Resources{Memory: 1 << 28, CPUQuota: 50000})
+	assert.Equal(t, int64(1<<28), res.Limits.MemoryBytes)
+	assert.Equal(t, int64(5e8), res.Limits.NanoCPUs)
+}
@@ -1,36 +1,203 @@
 package deploy
 
 import (
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Strategies used to pick the upstream that serves a request
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
 )
 
+// A single running instance (i.e. a container) that serves an address
+type upstream struct {
+	route    string
+	active   int64 // number of in-flight requests
+	failures int64 // number of consecutive requests that could not reach the upstream
+	retired  int32 // set once the upstream is removed while requests are in flight
+}
+
+// The upstreams serving an address
+type upstreamPool struct {
+	upstreams []*upstream
+	next      uint64 // round robin counter
+}
+
 // A cache for the routes. This is almost equivalent to an ingress controller
 // and is used primarily when the manager is just a Docker client. The routeMap
-// maps the address (i.e. /my-project/dev) to the actual address on the machine
-// (i.e. localhost:40000, kubernetes.default.svc/...)
+// maps the address (i.e. /my-project/dev) to a pool of actual addresses on the
+// machine (i.e. localhost:40000, kubernetes.default.svc/...) that requests are
+// balanced across.
+//
+// Upstreams removed while they still have requests in flight are retired until
+// those requests complete, so that their instance can be drained before it is
+// stopped. Evicted upstreams are remembered until they are restored, i.e. once they
+// pass a liveness probe, or their route is removed. An address whose upstreams are
+// all evicted stays routed with no upstreams, so that it can be told apart from an
+// address that isn't deployed
 type routeMap struct {
-	m      sync.RWMutex
-	routes map[string]string
+	m            sync.RWMutex
+	routes       map[string]*upstreamPool
+	retired      map[string]*upstream // removed upstreams with requests in flight, keyed by route
+	evicted      map[string]string    // address of each evicted route
+	balance      string               // one of the balance strategies. Defaults to round robin
+	evictAfter   int64                // consecutive failures before an upstream is evicted. 0 never evicts
+	drainTimeout time.Duration        // longest time Drain waits for requests in flight
 }
 
-// Set the route to the project key.
-func (r *routeMap) Set(addr, route string) {
+// Set the routes of the address, replacing any existing routes. Setting no routes
+// removes the address. The swap is atomic, new requests only go to the new routes
+// while requests in flight to the replaced routes can be drained
+func (r *routeMap) Set(addr string, routes ...string) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	r.routes[addr] = route
+	existing := make(map[string]*upstream)
+	if pool, ok := r.routes[addr]; ok {
+		for _, u := range pool.upstreams {
+			existing[u.route] = u
+		}
+	}
+
+	pool := &upstreamPool{}
+	for _, route := range routes {
+		// routes that are kept carry on with their requests in flight
+		u, ok := existing[route]
+		if !ok {
+			u = &upstream{route: route}
+		}
+		delete(existing, route)
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	for _, u := range existing {
+		r.retire(u)
+	}
+
+	r.forgetEvicted(addr)
+
+	if len(routes) == 0 {
+		delete(r.routes, addr)
+	} else {
+		r.routes[addr] = pool
+	}
 }
 
-// Get the route given the project key. If u
+// Add a route to the address' existing routes
+func (r *routeMap) Add(addr, route string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	pool, ok := r.routes[addr]
+	if !ok {
+		pool = &upstreamPool{}
+		r.routes[addr] = pool
+	}
+	for _, u := range pool.upstreams {
+		if u.route == route {
+			return
+		}
+	}
+	pool.upstreams = append(pool.upstreams, &upstream{route: route})
+}
+
+// Get a route for the address, picked by the balancing strategy. Returns an empty
+// string if the address has no routes
 func (r *routeMap) Get(addr string) string {
 	r.m.RLock()
 	defer r.m.RUnlock()
 
-	route, ok := r.routes[addr]
+	if u := r.pick(addr); u != nil {
+		return u.route
+	}
+	return ""
+}
+
+// Gets all the routes of the address
+func (r *routeMap) Routes(addr string) []string {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var routes []string
+	if pool, ok := r.routes[addr]; ok {
+		for _, u := range pool.upstreams {
+			routes = append(routes, u.route)
+		}
+	}
+	return routes
+}
+
+// Picks an upstream for the address and counts the request as in-flight until it is
+// released. Returns nil if the address has no routes
+func (r *routeMap) Acquire(addr string) *upstream {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	u := r.pick(addr)
+	if u != nil {
+		atomic.AddInt64(&u.active, 1)
+	}
+	return u
+}
+
+// Checks if the address is routed, even when all of its upstreams are evicted
+func (r *routeMap) Has(addr string) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	_, ok := r.routes[addr]
+	return ok
+}
+
+// Releases an upstream acquired for the address once the request completes. An
+// upstream that could not be reached for evictAfter requests in a row is removed.
+// The address is kept when its last upstream is evicted
+func (r *routeMap) Release(addr string, u *upstream, unreachable bool) {
+	if atomic.AddInt64(&u.active, -1) == 0 && atomic.LoadInt32(&u.retired) == 1 {
+		r.m.Lock()
+		if r.retired[u.route] == u {
+			delete(r.retired, u.route)
+		}
+		r.m.Unlock()
+	}
+	if !unreachable {
+		atomic.StoreInt64(&u.failures, 0)
+		return
+	}
+
+	if failures := atomic.AddInt64(&u.failures, 1); r.evictAfter > 0 && failures >= r.evictAfter {
+		r.m.Lock()
+		defer r.m.Unlock()
+		if r.remove(addr, u.route) {
+			r.evicted[u.route] = addr
+		}
+	}
+}
+
+// Routes the address to the evicted route again. Returns false if the route was not
+// evicted or has since been removed
+func (r *routeMap) Restore(route string) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	addr, ok := r.evicted[route]
+	if !ok {
+		return false
+	}
+	delete(r.evicted, route)
+
+	pool, ok := r.routes[addr]
 	if !ok {
-		return ""
+		pool = &upstreamPool{}
+		r.routes[addr] = pool
 	}
-	return route
+	pool.upstreams = append(pool.upstreams, &upstream{route: route})
+	return true
 }
 
 // Remove the address from the routeMap
@@ -38,12 +205,146 @@ func (r *routeMap) Delete(addr string) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
+	if pool, ok := r.routes[addr]; ok {
+		for _, u := range pool.upstreams {
+			r.retire(u)
+		}
+	}
 	delete(r.routes, addr)
+	r.forgetEvicted(addr)
+}
+
+// Remove the route from the address' routes. The address is removed once it has no
+// routes left, evicted ones included. This allows a replaced deployment to be removed
+// without affecting its successor
+func (r *routeMap) DeleteIf(addr, route string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.remove(addr, route)
+	if r.evicted[route] == addr {
+		delete(r.evicted, route)
+	}
+	if pool, ok := r.routes[addr]; ok && len(pool.upstreams) == 0 {
+		for _, a := range r.evicted {
+			if a == addr {
+				return
+			}
+		}
+		delete(r.routes, addr)
+	}
+}
+
+// Removes the route from the address' routes. The address is kept even if it has no
+// routes left. Returns false if the address was not routed to it. Must be called with
+// the lock held
+func (r *routeMap) remove(addr, route string) bool {
+	pool, ok := r.routes[addr]
+	if !ok {
+		return false
+	}
+
+	found := false
+	var upstreams []*upstream
+	for _, u := range pool.upstreams {
+		if u.route != route {
+			upstreams = append(upstreams, u)
+		} else {
+			r.retire(u)
+			found = true
+		}
+	}
+	pool.upstreams = upstreams
+	return found
+}
+
+// Forgets the evicted routes of the address once its routes are replaced. Must be
+// called with the lock held
+func (r *routeMap) forgetEvicted(addr string) {
+	for route, a := range r.evicted {
+		if a == addr {
+			delete(r.evicted, route)
+		}
+	}
+}
+
+// Waits for the requests in flight to the route to complete once it has been removed,
+// for at most the drain timeout. Returns false if the requests did not complete in time
+func (r *routeMap) Drain(route string) bool {
+	deadline := time.Now().Add(r.drainTimeout)
+	for {
+		r.m.RLock()
+		u, ok := r.retired[route]
+		r.m.RUnlock()
+		if !ok {
+			return true
+		}
+		if atomic.LoadInt64(&u.active) <= 0 {
+			r.forget(route, u)
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf("gave up draining '%s' with %d requests in flight after %s", route, atomic.LoadInt64(&u.active), r.drainTimeout)
+			r.forget(route, u)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Keeps track of the upstream's requests in flight once it is removed. Must be
+// called with the lock held
+func (r *routeMap) retire(u *upstream) {
+	if atomic.LoadInt64(&u.active) > 0 {
+		atomic.StoreInt32(&u.retired, 1)
+		r.retired[u.route] = u
+	}
+}
+
+// Stops tracking the retired upstream
+func (r *routeMap) forget(route string, u *upstream) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.retired[route] == u {
+		delete(r.retired, route)
+	}
+}
+
+// Picks the upstream for the next request. Must be called with the lock held
+func (r *routeMap) pick(addr string) *upstream {
+	pool, ok := r.routes[addr]
+	if !ok || len(pool.upstreams) == 0 {
+		return nil
+	}
+
+	n := uint64(len(pool.upstreams))
+	start := atomic.AddUint64(&pool.next, 1) - 1
+	if r.balance != balanceLeastConnections {
+		return pool.upstreams[start%n]
+	}
+
+	// starts from the round robin position so that ties are spread out
+	var best *upstream
+	for i := uint64(0); i < n; i++ {
+		u := pool.upstreams[(start+i)%n]
+		if best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+			best = u
+		}
+	}
+	return best
 }
 
 func newRouteMap() *routeMap {
-	return &routeMap{
-		sync.RWMutex{},
-		make(map[string]string),
+	r := &routeMap{
+		routes:       make(map[string]*upstreamPool),
+		retired:      make(map[string]*upstream),
+		evicted:      make(map[string]string),
+		balance:      balanceRoundRobin,
+		drainTimeout: 30 * time.Second,
+	}
+	if viper.IsSet("deploy.drain_timeout") {
+		r.drainTimeout = viper.GetDuration("deploy.drain_timeout")
 	}
+	return r
 }
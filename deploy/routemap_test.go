@@ -2,6 +2,7 @@ package deploy
 
 import (
 	"testing"
+	"time"
 
 	"github.com/docker/docker/pkg/testutil/assert"
 )
@@ -31,3 +32,169 @@ func TestRouteMap_Delete(t *testing.T) {
 	rm.Delete("del-test")
 	assert.Equal(t, rm.Get(testName), "")
 }
+
+func TestRouteMap_DeleteIf(t *testing.T) {
+	testName, value := "del-if-test", "del-if-test-value"
+	rm.Set(testName, value)
+	rm.DeleteIf(testName, "other-value")
+	assert.Equal(t, rm.Get(testName), value)
+	rm.DeleteIf(testName, value)
+	assert.Equal(t, rm.Get(testName), "")
+}
+
+func TestRouteMap_RoundRobin(t *testing.T) {
+	r := newRouteMap()
+	r.Set("rr", "a", "b", "c")
+	r.Add("rr", "d")
+	r.Add("rr", "a")
+	assert.DeepEqual(t, r.Routes("rr"), []string{"a", "b", "c", "d"})
+
+	var picked []string
+	for i := 0; i < 8; i++ {
+		picked = append(picked, r.Get("rr"))
+	}
+	assert.DeepEqual(t, picked, []string{"a", "b", "c", "d", "a", "b", "c", "d"})
+}
+
+func TestRouteMap_LeastConnections(t *testing.T) {
+	r := newRouteMap()
+	r.balance = balanceLeastConnections
+	r.Set("lc", "a", "b")
+
+	busy := r.Acquire("lc")
+	assert.Equal(t, busy.route, "a")
+	// a stays busy so every request goes to b
+	for i := 0; i < 3; i++ {
+		u := r.Acquire("lc")
+		assert.Equal(t, u.route, "b")
+		r.Release("lc", u, false)
+	}
+	r.Release("lc", busy, false)
+}
+
+func TestRouteMap_Evict(t *testing.T) {
+	r := newRouteMap()
+	r.evictAfter = 2
+	r.Set("evict", "dead", "alive")
+	acquireDead := func() *upstream {
+		for {
+			u := r.Acquire("evict")
+			if u.route == "dead" {
+				return u
+			}
+			r.Release("evict", u, false)
+		}
+	}
+
+	r.Release("evict", acquireDead(), true)
+	assert.DeepEqual(t, r.Routes("evict"), []string{"dead", "alive"})
+
+	// a success in between resets the count
+	r.Release("evict", acquireDead(), false)
+	r.Release("evict", acquireDead(), true)
+	assert.DeepEqual(t, r.Routes("evict"), []string{"dead", "alive"})
+
+	r.Release("evict", acquireDead(), true)
+	assert.DeepEqual(t, r.Routes("evict"), []string{"alive"})
+}
+
+func TestRouteMap_EvictLast(t *testing.T) {
+	r := newRouteMap()
+	r.evictAfter = 1
+	r.Set("evict", "dead")
+	r.Release("evict", r.Acquire("evict"), true)
+
+	// the address stays routed with no upstreams until the route is restored
+	assert.Equal(t, r.Has("evict"), true)
+	assert.Equal(t, r.Acquire("evict") == nil, true)
+	assert.Equal(t, r.Restore("dead"), true)
+	assert.Equal(t, r.Get("evict"), "dead")
+
+	// or the deployment is stopped
+	r.Release("evict", r.Acquire("evict"), true)
+	r.DeleteIf("evict", "dead")
+	assert.Equal(t, r.Has("evict"), false)
+
+	r.Set("evict", "dead")
+	r.Release("evict", r.Acquire("evict"), true)
+	r.Delete("evict")
+	assert.Equal(t, r.Has("evict"), false)
+}
+
+func TestRouteMap_Restore(t *testing.T) {
+	r := newRouteMap()
+	r.evictAfter = 1
+	r.Set("evict", "dead")
+	r.Release("evict", r.Acquire("evict"), true)
+	assert.Equal(t, r.Get("evict"), "")
+
+	assert.Equal(t, r.Restore("dead"), true)
+	assert.DeepEqual(t, r.Routes("evict"), []string{"dead"})
+	// routes are only restored once
+	assert.Equal(t, r.Restore("dead"), false)
+	assert.DeepEqual(t, r.Routes("evict"), []string{"dead"})
+
+	// routes removed after their eviction are not restored
+	r.Release("evict", r.Acquire("evict"), true)
+	r.DeleteIf("evict", "dead")
+	assert.Equal(t, r.Restore("dead"), false)
+
+	r.Set("evict", "dead", "alive")
+	r.Release("evict", acquireRoute(r, "evict", "dead"), true)
+	r.Set("evict", "replacement")
+	assert.Equal(t, r.Restore("dead"), false)
+	assert.DeepEqual(t, r.Routes("evict"), []string{"replacement"})
+}
+
+// Acquires the upstream of the route, releasing the other ones picked on the way
+func acquireRoute(r *routeMap, addr, route string) *upstream {
+	for {
+		u := r.Acquire(addr)
+		if u.route == route {
+			return u
+		}
+		r.Release(addr, u, false)
+	}
+}
+
+func TestRouteMap_SetKeepsInFlight(t *testing.T) {
+	r := newRouteMap()
+	r.Set("keep", "a")
+	u := r.Acquire("keep")
+	r.Set("keep", "a", "b")
+	// the request in flight to a is still counted once the routes are replaced
+	r.balance = balanceLeastConnections
+	assert.Equal(t, r.Acquire("keep").route, "b")
+	r.Release("keep", u, false)
+}
+
+func TestRouteMap_Drain(t *testing.T) {
+	r := newRouteMap()
+	r.Set("drain", "old")
+	u := r.Acquire("drain")
+	r.Set("drain", "new")
+	assert.Equal(t, r.Get("drain"), "new")
+
+	done := make(chan bool)
+	go func() { done <- r.Drain("old") }()
+	select {
+	case <-done:
+		t.Fatal("drained with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.Release("drain", u, false)
+	assert.Equal(t, <-done, true)
+
+	// nothing in flight, nothing to wait for
+	assert.Equal(t, r.Drain("new"), true)
+}
+
+func TestRouteMap_DrainTimeout(t *testing.T) {
+	r := newRouteMap()
+	r.drainTimeout = 20 * time.Millisecond
+	r.Set("timeout", "old")
+	u := r.Acquire("timeout")
+	r.Delete("timeout")
+	assert.Equal(t, r.Drain("old"), false)
+	r.Release("timeout", u, false)
+}
@@ -3,23 +3,78 @@ package deploy
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/docker/docker/api/types/filters"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
+	"warden/store/model"
 	"warden/utils"
 )
 
+// Docker only allows [a-zA-Z0-9][a-zA-Z0-9_.-] in container and service names
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Service names double as DNS names on the overlay network (and in Kubernetes), which
+// only allow lowercase alphanumerics and '-'
+var invalidDNSChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Labels set on the containers, services and Kubernetes objects created by warden. They
+// mark the objects as owned by warden and identify the deployment they run, so they
+// are used to find the objects to stop, clean up or adopt instead of their names
+const (
+	labelInstance   = "warden.instance"
+	labelDeployment = "warden.deployment"
+	labelAddress    = "warden.address"
+	labelProject    = "warden.project"
+	labelAlias      = "warden.alias"
+	labelCommit     = "warden.commit"
+	labelMaxReplica = "warden.replicas.max"
+	labelReplica    = "warden.replica"
+)
+
 var once sync.Once
 var manager Manager
 var managerError error
 
+var (
+	// Returned when no instance is serving the requested project and alias
+	ErrInstanceNotFound = errors.New("no instance found for the requested project and alias")
+	// Returned when the instance serving the request could not be reached
+	ErrInstanceUnreachable = errors.New("instance could not be reached")
+	// Returned when the instance serving the request did not respond in time
+	ErrInstanceTimeout = errors.New("instance did not respond in time")
+	// Returned when the request's method cannot be forwarded to an instance
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// Returned when the request's path or headers cannot be forwarded to an instance
+	ErrInvalidRequest = errors.New("invalid request")
+	// Returned when the client went away before the instance responded
+	ErrRequestCancelled = errors.New("request cancelled by the client")
+)
+
+// Manager controls the deployment of instances onto the runtime (Docker, Swarm or
+// Kubernetes)
 type Manager interface {
+	// Releases the runtime's client and stops any background work
 	Close() error
+	// Deploys the instance and routes its address to it once it is ready
 	DeployInstance(d Deployment) error
+	// Brings the runtime in line with the desired deployments. The ones already running
+	// are routed to, missing ones are deployed and any other deployment made by warden
+	// is removed
+	Reconcile(desired []Deployment) error
+	// Forwards the request to the instance of its project and alias. Errors can be
+	// inspected with errors.Cause to check for ErrInstanceNotFound,
+	// ErrInstanceUnreachable, ErrInstanceTimeout or ErrMethodNotAllowed
 	RunInstance(r *http.Request) (*http.Response, error)
+	// Sets the number of replicas of a deployed instance
+	ScaleInstance(d Deployment, replicas int) error
+	// Stops the instance and removes the routes to it
 	StopInstance(d Deployment) error
 }
 
@@ -35,22 +90,45 @@ func NewManager() (Manager, error) {
 		case "docker":
 			manager, managerError = newDockerRunner()
 		case "swarm":
-			managerError = errors.New("Swarm manager is not yet implemented")
+			manager, managerError = newSwarmManager()
 		case "kubernetes", "k8s":
-			managerError = errors.New("Kubernetes manager is not yet implemented")
+			manager, managerError = newKubernetesManager()
 		default:
 			managerError = errors.Errorf("Unknown deploy type: %s", r)
 		}
+
+		// the autoscaler also starts and stops instances that scale to zero, so it
+		// wraps the manager even when scaling on load is disabled
+		if managerError == nil {
+			config, err := autoscaleConfigFromViper()
+			if err != nil {
+				managerError = err
+				return
+			}
+			scaler := newAutoscaler(manager, config)
+			go scaler.run()
+			// the split picks the address before the autoscaler sees the request, so
+			// that the address the request is sent to is the one started from zero.
+			// Requests are mirrored as the caller sent them, before they are split
+			manager = newMirror(newSplitter(scaler), mirrorConfigFromViper())
+		}
 	})
 	return manager, managerError
 }
 
 type Deployment struct {
-	Alias      string
-	Project    string
-	Hash       string
-	MinReplica int
-	MaxReplica int
+	Alias        string
+	Project      string
+	Hash         string
+	MinReplica   int
+	MaxReplica   int
+	InstanceID   uint               // ID of the stored instance. Only used to label the deployment
+	DeploymentID uint               // ID of the stored deployment. Only used to label the deployment
+	Resources    model.Resources    // limits of each replica before the server-wide limits are applied
+	Env          map[string]string  // environment variables passed to the replicas
+	Secrets      []string           // names of the variables in Env whose values are secret
+	Split        model.TrafficSplit // share of the requests sent to other commits of the project
+	Mirror       string             // alias of the project that receives a copy of the requests, if any
 }
 
 // Validate and set sane defaults for the Deployment object
@@ -69,6 +147,7 @@ func (d *Deployment) validate() error {
 	if d.Alias == "latest" {
 		d.Alias = ""
 	}
+	d.Mirror = utils.StrLowerTrim(d.Mirror)
 
 	// setting up min and max replicas
 	if d.MinReplica == 0 && d.MaxReplica == 0 {
@@ -102,6 +181,152 @@ func (d *Deployment) ImageName() string {
 	return utils.StrLowerTrim(fmt.Sprintf("%s/%s:%s", addr, d.Project, d.Hash))
 }
 
+// Gets the name of the container running the deployment. The name is unique for
+// each project, alias and commit hash
+func (d *Deployment) ContainerName() string {
+	name := fmt.Sprintf("warden.%s.%s.%s", d.Project, d.aliasName(), d.Hash)
+	return invalidNameChars.ReplaceAllString(utils.StrLowerTrim(name), "-")
+}
+
+// Gets the name of a container running one of the deployment's replicas. The
+// deployment ID is part of the name so that a commit can be redeployed while its
+// previous deployment is still running
+func (d *Deployment) replicaName(replica int) string {
+	if d.DeploymentID == 0 {
+		return fmt.Sprintf("%s.%d", d.ContainerName(), replica)
+	}
+	return fmt.Sprintf("%s.%d.%d", d.ContainerName(), d.DeploymentID, replica)
+}
+
+// Gets the name of the service running the deployment on a cluster. The name is a
+// valid DNS label as it is used to reach the service. The commit hash is shortened
+// to 12 characters to leave room for the project and alias. As with containers, the
+// deployment ID ends the name
+func (d *Deployment) ServiceName() string {
+	hash := d.Hash
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	name := dnsLabel(fmt.Sprintf("warden-%s-%s-%s", d.Project, d.aliasName(), hash))
+	if d.DeploymentID == 0 {
+		return name
+	}
+
+	suffix := fmt.Sprintf("-%d", d.DeploymentID)
+	if len(name)+len(suffix) > 63 {
+		name = strings.Trim(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// Reports whether the deployment runs the same commit as the other one. Deployments
+// of the same commit are told apart by their deployment IDs, unless either is unknown
+func (d *Deployment) sameAs(other Deployment) bool {
+	if d.Hash != other.Hash {
+		return false
+	}
+	return d.DeploymentID == 0 || other.DeploymentID == 0 || d.DeploymentID == other.DeploymentID
+}
+
+// Gets the name shared by every deployment of the project and alias. Used by the
+// managers that update the objects serving an address in place rather than running
+// a new service for each commit
+func (d *Deployment) AddressName() string {
+	return dnsLabel(fmt.Sprintf("warden-%s-%s", d.Project, d.aliasName()))
+}
+
+func (d *Deployment) aliasName() string {
+	if d.Alias == "" {
+		return "latest"
+	}
+	return d.Alias
+}
+
+// Converts the name to a valid DNS label (lowercase alphanumerics and '-', at most
+// 63 characters)
+func dnsLabel(name string) string {
+	name = invalidDNSChars.ReplaceAllString(utils.StrLowerTrim(name), "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.Trim(name, "-")
+}
+
+// Gets the labels identifying the deployment
+func (d *Deployment) labels() map[string]string {
+	return map[string]string{
+		labelInstance:   strconv.FormatUint(uint64(d.InstanceID), 10),
+		labelDeployment: strconv.FormatUint(uint64(d.DeploymentID), 10),
+		labelAddress:    d.Address(),
+		labelProject:    utils.StrLowerTrim(d.Project),
+		labelAlias:      d.Alias,
+		labelCommit:     d.Hash,
+		labelMaxReplica: strconv.Itoa(d.MaxReplica),
+	}
+}
+
+// Gets the names of the environment variables in order, so that the specs created
+// for the deployment don't change between calls
+func (d *Deployment) envNames() []string {
+	names := make([]string, 0, len(d.Env))
+	for name := range d.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Gets the environment variables as "NAME=value" pairs
+func (d *Deployment) envList() []string {
+	var env []string
+	for _, name := range d.envNames() {
+		env = append(env, name+"="+d.Env[name])
+	}
+	return env
+}
+
+// Gets the label filters matching the objects running the deployment. Objects of
+// any deployment of the commit match if the deployment ID is unknown
+func (d *Deployment) labelFilters() filters.Args {
+	ftr := filters.NewArgs()
+	ftr.Add("label", labelAddress+"="+d.Address())
+	ftr.Add("label", labelCommit+"="+d.Hash)
+	if d.DeploymentID != 0 {
+		ftr.Add("label", labelDeployment+"="+strconv.FormatUint(uint64(d.DeploymentID), 10))
+	}
+	return ftr
+}
+
+// Gets the key identifying the deployment among the desired deployments
+func (d *Deployment) key() string {
+	return d.Address() + "@" + d.Hash
+}
+
+// Recreates the deployment from the labels set on the objects running it
+func deploymentFromLabels(labels map[string]string) Deployment {
+	d := Deployment{
+		Project: labels[labelProject],
+		Alias:   labels[labelAlias],
+		Hash:    labels[labelCommit],
+	}
+	d.MaxReplica, _ = strconv.Atoi(labels[labelMaxReplica])
+	if id, err := strconv.ParseUint(labels[labelInstance], 10, 64); err == nil {
+		d.InstanceID = uint(id)
+	}
+	if id, err := strconv.ParseUint(labels[labelDeployment], 10, 64); err == nil {
+		d.DeploymentID = uint(id)
+	}
+	return d
+}
+
+// Joins the errors into one. Returns nil if there are none
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
 // Gets the tail address (without the domain) for the deployment.
 func (d *Deployment) Address() string {
 	route := d.Project
@@ -0,0 +1,76 @@
+package deploy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployment_Validate(t *testing.T) {
+	d := Deployment{Alias: " Latest ", Project: "proj", Hash: "abc"}
+	assert.Nil(t, d.validate())
+	assert.Equal(t, "", d.Alias)
+	assert.Equal(t, 1, d.MinReplica)
+	assert.Equal(t, 1, d.MaxReplica)
+	assert.Equal(t, "proj", d.Address())
+
+	d = Deployment{Project: "proj", Hash: "abc", MinReplica: 2, MaxReplica: 1}
+	assert.EqualError(t, d.validate(), "Max replica must be >= min replica")
+
+	d = Deployment{}
+	assert.NotNil(t, d.validate())
+}
+
+func TestDeployment_ContainerName(t *testing.T) {
+	d := Deployment{Project: "My Proj", Hash: "95bfc35"}
+	assert.Equal(t, "warden.my-proj.latest.95bfc35", d.ContainerName())
+
+	d.Alias = "dev"
+	assert.Equal(t, "warden.my-proj.dev.95bfc35", d.ContainerName())
+}
+
+func TestDeployment_ServiceName(t *testing.T) {
+	d := Deployment{Project: "My_Proj", Hash: "95bfc35a41e3d2b0c8c1f6de7ac3f0d2a1b2c3d4"}
+	assert.Equal(t, "warden-my-proj-latest-95bfc35a41e3", d.ServiceName())
+
+	d.Alias = "dev"
+	assert.Equal(t, "warden-my-proj-dev-95bfc35a41e3", d.ServiceName())
+
+	d.Project = strings.Repeat("p", 70)
+	assert.Equal(t, 63, len(d.ServiceName()))
+
+	d.DeploymentID = 42
+	assert.Equal(t, 63, len(d.ServiceName()))
+	assert.True(t, strings.HasSuffix(d.ServiceName(), "-42"))
+}
+
+func TestDeployment_ReplicaName(t *testing.T) {
+	d := Deployment{Project: "proj", Hash: "95bfc35"}
+	assert.Equal(t, "warden.proj.latest.95bfc35.1", d.replicaName(1))
+
+	d.DeploymentID = 7
+	assert.Equal(t, "warden.proj.latest.95bfc35.7.1", d.replicaName(1))
+}
+
+func TestDeployment_SameAs(t *testing.T) {
+	d := Deployment{Hash: "abc", DeploymentID: 1}
+	assert.True(t, d.sameAs(Deployment{Hash: "abc", DeploymentID: 1}))
+	assert.True(t, d.sameAs(Deployment{Hash: "abc"}))
+	assert.False(t, d.sameAs(Deployment{Hash: "abc", DeploymentID: 2}))
+	assert.False(t, d.sameAs(Deployment{Hash: "def", DeploymentID: 1}))
+}
+
+func TestDeployment_AddressName(t *testing.T) {
+	d := Deployment{Project: "My_Proj", Hash: "95bfc35"}
+	assert.Equal(t, "warden-my-proj-latest", d.AddressName())
+
+	d.Alias = "dev"
+	assert.Equal(t, "warden-my-proj-dev", d.AddressName())
+}
+
+func TestDeployment_EnvList(t *testing.T) {
+	d := Deployment{Env: map[string]string{"B": "2", "A_1": "x=y", "A": ""}}
+	assert.Equal(t, []string{"A=", "A_1=x=y", "B=2"}, d.envList())
+	assert.Nil(t, (&Deployment{}).envList())
+}
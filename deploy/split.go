@@ -0,0 +1,184 @@
+package deploy
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+)
+
+// Sends a share of each alias' requests to the other commits in its deployment's
+// traffic split. The splitter wraps the Manager and keeps the deployment serving every
+// address so that it can tell which address serves each commit of a project. The
+// chosen address then handles the request as if it had been called directly.
+//
+// Requests stay with the alias' own commit if no address of the project serves the
+// commit they were assigned to
+type splitter struct {
+	mgr         Manager
+	m           sync.RWMutex
+	deployments map[string]Deployment // keyed by address
+	random      func() int            // bucket of requests that aren't sticky, in [0, 100)
+}
+
+// Deploys the instance and routes the share of its split to the other commits
+func (s *splitter) DeployInstance(d Deployment) error {
+	if err := s.mgr.DeployInstance(d); err != nil {
+		return err
+	}
+	_ = d.validate()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.deployments[d.Address()] = d
+	return nil
+}
+
+// Reconciles the underlying Manager, then routes the splits of the desired deployments
+func (s *splitter) Reconcile(desired []Deployment) error {
+	err := s.mgr.Reconcile(desired)
+
+	deployments := make(map[string]Deployment)
+	for _, d := range desired {
+		_ = d.validate()
+		deployments[d.Address()] = d
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.deployments = deployments
+	return err
+}
+
+// Stops the instance. Its address no longer receives a share of other aliases'
+// requests unless it has since been deployed with another commit
+func (s *splitter) StopInstance(d Deployment) error {
+	if err := s.mgr.StopInstance(d); err != nil {
+		return err
+	}
+	_ = d.validate()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if current, ok := s.deployments[d.Address()]; ok && current.sameAs(d) {
+		delete(s.deployments, d.Address())
+	}
+	return nil
+}
+
+func (s *splitter) ScaleInstance(d Deployment, replicas int) error {
+	return s.mgr.ScaleInstance(d, replicas)
+}
+
+// Runs the instance that the request is assigned to by its alias' traffic split
+func (s *splitter) RunInstance(r *http.Request) (*http.Response, error) {
+	payload, err := NewPayload(r)
+	if err != nil {
+		return s.mgr.RunInstance(r)
+	}
+
+	if target, ok := s.target(payload.Address(), r); ok {
+		r = withAlias(r, target.Alias)
+	}
+	return s.mgr.RunInstance(r)
+}
+
+func (s *splitter) Close() error {
+	return s.mgr.Close()
+}
+
+// Gets the deployment that serves the commit the request is assigned to. Returns false
+// if the request stays with the address' own deployment
+func (s *splitter) target(addr string, r *http.Request) (Deployment, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	d, ok := s.deployments[addr]
+	if !ok || len(d.Split.Split) == 0 {
+		return Deployment{}, false
+	}
+
+	bucket, sticky := stickyBucket(d, r)
+	if !sticky {
+		bucket = s.random()
+	}
+	hash := ""
+	for _, t := range d.Split.Split {
+		if bucket < t.Weight {
+			hash = t.CommitHash
+			break
+		}
+		bucket -= t.Weight
+	}
+	if hash == "" {
+		return Deployment{}, false
+	}
+
+	// the split may name a shortened hash. The first address in order is taken if
+	// several serve the commit so that requests are assigned consistently
+	var target Deployment
+	found := false
+	for a, other := range s.deployments {
+		if a == addr || other.Project != d.Project || !strings.HasPrefix(other.Hash, hash) {
+			continue
+		}
+		if !found || a < target.Address() {
+			target, found = other, true
+		}
+	}
+	return target, found
+}
+
+// Gets the bucket of the request from the value of the deployment's sticky header or
+// cookie. Returns false if the request has neither
+func stickyBucket(d Deployment, r *http.Request) (int, bool) {
+	key := ""
+	if d.Split.StickyHeader != "" {
+		key = r.Header.Get(d.Split.StickyHeader)
+	}
+	if key == "" && d.Split.StickyCookie != "" {
+		if c, err := r.Cookie(d.Split.StickyCookie); err == nil {
+			key = c.Value
+		}
+	}
+	if key == "" {
+		return 0, false
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % 100), true
+}
+
+// Gets a copy of the request routed to another alias of its project
+func withAlias(r *http.Request, alias string) *http.Request {
+	rctx := chi.NewRouteContext()
+	replaced := false
+	if current, ok := r.Context().Value(chi.RouteCtxKey).(*chi.Context); ok {
+		*rctx = *current
+		rctx.URLParams = chi.RouteParams{}
+		for i, key := range current.URLParams.Keys {
+			value := current.URLParams.Values[i]
+			if key == "alias" {
+				value, replaced = alias, true
+			}
+			rctx.URLParams.Add(key, value)
+		}
+	}
+	if !replaced {
+		rctx.URLParams.Add("alias", alias)
+	}
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func newSplitter(mgr Manager) *splitter {
+	return &splitter{
+		mgr:         mgr,
+		deployments: make(map[string]Deployment),
+		random:      func() int { return rand.Intn(100) },
+	}
+}
@@ -0,0 +1,97 @@
+package deploy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
+)
+
+// A Manager that records the address each request is run on
+type addrManager struct {
+	*fakeManager
+	served []string
+}
+
+func (f *addrManager) RunInstance(r *http.Request) (*http.Response, error) {
+	payload, err := NewPayload(r)
+	if err != nil {
+		return nil, err
+	}
+	f.served = append(f.served, payload.Address())
+	return f.fakeManager.RunInstance(r)
+}
+
+func newFakeSplitter(t *testing.T) (*splitter, *addrManager) {
+	mgr := &addrManager{fakeManager: &fakeManager{clock: &fakeClock{t: time.Unix(0, 0)}, replicas: make(map[string]int)}}
+	s := newSplitter(mgr)
+	assert.Nil(t, s.DeployInstance(Deployment{Project: "proj", Alias: "canary", Hash: "0c0aafa7ec12"}))
+	assert.Nil(t, s.DeployInstance(Deployment{Project: "other", Alias: "canary", Hash: "1d2e3f4"}))
+	assert.Nil(t, s.DeployInstance(Deployment{
+		Project: "proj",
+		Hash:    "95bfc35",
+		Split: model.TrafficSplit{
+			Split:        model.Split{{CommitHash: "0c0aafa", Weight: 10}, {CommitHash: "1d2e3f4", Weight: 10}},
+			StickyHeader: "X-User-Id",
+		},
+	}))
+	return s, mgr
+}
+
+func TestSplitter_Weights(t *testing.T) {
+	s, mgr := newFakeSplitter(t)
+
+	for _, bucket := range []int{0, 9, 10, 19, 20, 99} {
+		s.random = func() int { return bucket }
+		_, err := s.RunInstance(newExecRequest("proj", "latest"))
+		assert.Nil(t, err)
+	}
+	// the second commit is only served by another project, so its share stays with
+	// the alias' own commit
+	assert.Equal(t, []string{"proj/canary", "proj/canary", "proj", "proj", "proj", "proj"}, mgr.served)
+
+	// requests to the canary itself are not split
+	mgr.served = nil
+	_, err := s.RunInstance(newExecRequest("proj", "canary"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"proj/canary"}, mgr.served)
+}
+
+func TestSplitter_Sticky(t *testing.T) {
+	s, mgr := newFakeSplitter(t)
+	calls := 0
+	s.random = func() int { calls++; return 0 }
+
+	for i := 0; i < 5; i++ {
+		r := newExecRequest("proj", "latest")
+		r.Header.Set("X-User-Id", "user-42")
+		_, err := s.RunInstance(r)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 0, calls)
+	for _, addr := range mgr.served {
+		assert.Equal(t, mgr.served[0], addr)
+	}
+
+	bucket, sticky := stickyBucket(Deployment{Split: model.TrafficSplit{StickyCookie: "session"}}, newExecRequest("proj", "latest"))
+	assert.False(t, sticky)
+	assert.Equal(t, 0, bucket)
+
+	r := newExecRequest("proj", "latest")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	_, sticky = stickyBucket(Deployment{Split: model.TrafficSplit{StickyCookie: "session"}}, r)
+	assert.True(t, sticky)
+}
+
+func TestSplitter_StopInstance(t *testing.T) {
+	s, mgr := newFakeSplitter(t)
+	s.random = func() int { return 0 }
+	assert.Nil(t, s.StopInstance(Deployment{Project: "proj", Alias: "canary", Hash: "0c0aafa7ec12"}))
+
+	_, err := s.RunInstance(newExecRequest("proj", "latest"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"proj"}, mgr.served)
+}
@@ -0,0 +1,425 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"warden/store/model"
+	"warden/utils"
+)
+
+// Deploys instances as services on a Docker Swarm. Instances are not published on
+// host ports, they are reached through the overlay network which the warden must
+// also be attached to. The swarm's DNS resolves the service name to a virtual IP
+// that balances the requests across the service's replicas. Replicas that exit are
+// restarted by the swarm, services with replicas that fail the liveness probe have
+// their tasks replaced
+type swarmManager struct {
+	routes   *routeMap
+	client   *http.Client // forwards the requests to the services
+	ctx      context.Context
+	cli      *client.Client
+	network  string // overlay network the services are attached to
+	port     int    // port the instances listen on
+	liveness probe  // run by the warden against each of the services' replicas
+	limits   resourceLimits
+	stop     chan struct{}
+
+	waitReady   func(route string) error            // waits for the service to pass the readiness probe
+	lookupTasks func(host string) ([]string, error) // resolves the IPs of a service's replicas
+}
+
+// Deploys an instance as a swarm service with MinReplica replicas. If the service
+// already exists, it is updated instead. The deployment's address is routed to the
+// service once it passes the readiness probe, replacing any existing route
+func (m *swarmManager) DeployInstance(d Deployment) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	// the swarm only mounts its secrets as files, env vars are kept in the service spec
+	if len(d.Secrets) > 0 {
+		return errors.Errorf("secret environment variables are not supported on swarm as they would be stored in plain text in the service's spec. Set %s as plain variables instead", strings.Join(d.Secrets, ", "))
+	}
+	warnProcessLimits(d, "swarm")
+
+	spec := m.serviceSpec(d)
+	svc, err := m.findService(d)
+	if err != nil {
+		return err
+	}
+
+	if svc == nil {
+		if _, err := m.cli.ServiceCreate(m.ctx, spec, types.ServiceCreateOptions{}); err != nil {
+			return errors.Wrapf(err, "could not create service: %s", spec.Name)
+		}
+	} else {
+		if _, err := m.cli.ServiceUpdate(m.ctx, svc.ID, svc.Version, spec, types.ServiceUpdateOptions{}); err != nil {
+			return errors.Wrapf(err, "could not update service: %s", spec.Name)
+		}
+	}
+
+	route := m.serviceRoute(spec.Name)
+	if d.MinReplica > 0 {
+		if err := m.waitReady(route); err != nil {
+			return err
+		}
+	}
+	m.routes.Set(d.Address(), route)
+
+	return nil
+}
+
+// Removes the deployment's service from the swarm. If the service doesn't exist,
+// nothing is done. The deployment's address is only unrouted if it still points to
+// the removed service. The requests in flight to the service are drained before it
+// is removed
+func (m *swarmManager) StopInstance(d Deployment) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	svc, err := m.findService(d)
+	if err != nil {
+		return err
+	}
+	if svc == nil {
+		return nil
+	}
+
+	name := svc.Spec.Name
+	route := m.serviceRoute(name)
+	m.routes.DeleteIf(d.Address(), route)
+	m.routes.Drain(route)
+	if err := m.cli.ServiceRemove(m.ctx, svc.ID); err != nil {
+		return errors.Wrapf(err, "error removing service: %s", name)
+	}
+	return nil
+}
+
+// Sets the number of replicas of the deployment's service. When the service is
+// started from zero replicas, waits for it to pass the readiness probe
+func (m *swarmManager) ScaleInstance(d Deployment, replicas int) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	if replicas < 0 {
+		return errors.Errorf("cannot scale deployment to %d replicas", replicas)
+	}
+
+	svc, err := m.findService(d)
+	if err != nil {
+		return err
+	}
+	if svc == nil {
+		return errors.Errorf("service '%s' does not exist", d.ServiceName())
+	}
+	name := svc.Spec.Name
+
+	var previous uint64
+	if svc.Spec.Mode.Replicated != nil && svc.Spec.Mode.Replicated.Replicas != nil {
+		previous = *svc.Spec.Mode.Replicated.Replicas
+	}
+
+	count := uint64(replicas)
+	spec := svc.Spec
+	spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &count}
+	if _, err := m.cli.ServiceUpdate(m.ctx, svc.ID, svc.Version, spec, types.ServiceUpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "could not scale service: %s", name)
+	}
+
+	// a service started from zero replicas can't be reached until its first task runs
+	if previous == 0 && count > 0 {
+		return m.waitReady(m.serviceRoute(name))
+	}
+	return nil
+}
+
+// Runs the instance specified by the request's project and alias. The response
+// returned is the instance's response and it is up to the caller to close its body
+func (m *swarmManager) RunInstance(r *http.Request) (*http.Response, error) {
+	return runInstance(m.client, m.routes, r)
+}
+
+// Stops probing the services and closes the Docker client. Services are left running
+// on the swarm, their routes are rebuilt when the manager is next created
+func (m *swarmManager) Close() error {
+	close(m.stop)
+	if err := m.cli.Close(); err != nil {
+		return errors.Wrap(err, "error stopping swarm deploy cli")
+	}
+	return nil
+}
+
+// Finds the service running the deployment from its labels. Returns nil if there is
+// no such service
+func (m *swarmManager) findService(d Deployment) (*swarm.Service, error) {
+	services, err := m.cli.ServiceList(m.ctx, types.ServiceListOptions{Filters: d.labelFilters()})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing services of: %s", d.key())
+	}
+
+	for _, svc := range services {
+		current := deploymentFromLabels(svc.Spec.Labels)
+		if svc.Spec.Labels[labelAddress] == d.Address() && current.sameAs(d) {
+			return &svc, nil
+		}
+	}
+	return nil, nil
+}
+
+// Reconciles the services on the swarm with the desired deployments. Services are
+// matched to the deployments by their labels. Desired services are routed to, the
+// missing ones are deployed and services of other deployments are removed
+func (m *swarmManager) Reconcile(desired []Deployment) error {
+	want := make(map[string]Deployment)
+	for _, d := range desired {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		want[d.key()] = d
+	}
+
+	services, err := m.listServices()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	found := make(map[string]bool)
+	for _, svc := range services {
+		d := deploymentFromLabels(svc.Spec.Labels)
+		// a service of the commit left behind by a previous deployment is a stray too
+		if w, ok := want[d.key()]; !ok || !w.sameAs(d) {
+			log.Printf("removing service '%s' as it is no longer deployed", svc.Spec.Name)
+			if err := m.cli.ServiceRemove(m.ctx, svc.ID); err != nil {
+				errs = append(errs, errors.Wrapf(err, "error removing service: %s", svc.Spec.Name).Error())
+			}
+			m.routes.DeleteIf(d.Address(), m.serviceRoute(svc.Spec.Name))
+			continue
+		}
+		found[d.key()] = true
+		if route := m.serviceRoute(svc.Spec.Name); m.routes.Get(d.Address()) != route {
+			m.routes.Set(d.Address(), route)
+		}
+	}
+
+	for key, d := range want {
+		if found[key] {
+			continue
+		}
+		if err := m.DeployInstance(d); err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not reconcile '%s'", key).Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Rebuilds the routes from the services created by warden
+func (m *swarmManager) loadRoutes() error {
+	services, err := m.listServices()
+	if err != nil {
+		return err
+	}
+
+	for _, svc := range services {
+		m.routes.Set(svc.Spec.Labels[labelAddress], m.serviceRoute(svc.Spec.Name))
+	}
+	return nil
+}
+
+// Lists the services created by warden
+func (m *swarmManager) listServices() ([]swarm.Service, error) {
+	ftr := filters.NewArgs()
+	ftr.Add("label", labelAddress)
+	services, err := m.cli.ServiceList(m.ctx, types.ServiceListOptions{Filters: ftr})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing warden services")
+	}
+
+	var managed []swarm.Service
+	for _, svc := range services {
+		if _, ok := svc.Spec.Labels[labelAddress]; ok {
+			managed = append(managed, svc)
+		}
+	}
+	return managed, nil
+}
+
+// Gets the address the service is reached at on the overlay network
+func (m *swarmManager) serviceRoute(name string) string {
+	return fmt.Sprintf("%s:%d", name, m.port)
+}
+
+func (m *swarmManager) serviceSpec(d Deployment) swarm.ServiceSpec {
+	replicas := uint64(d.MinReplica)
+	labels := d.labels()
+
+	return swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   d.ServiceName(),
+			Labels: labels,
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{
+				Image:       d.ImageName(),
+				Labels:      labels,
+				Env:         d.envList(),
+				Healthcheck: &container.HealthConfig{Test: []string{"NONE"}}, // probed by the warden instead
+			},
+			Networks:  []swarm.NetworkAttachmentConfig{{Target: m.network}},
+			Resources: serviceResources(m.limits.apply(d)),
+		},
+		Mode: swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+		},
+		EndpointSpec: &swarm.EndpointSpec{Mode: swarm.ResolutionModeVIP},
+	}
+}
+
+// Checks the liveness of every service's replicas at each interval
+func (m *swarmManager) watchLiveness() {
+	ticker := time.NewTicker(m.liveness.interval)
+	defer ticker.Stop()
+
+	failures := make(map[string]int)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.checkLiveness(failures)
+		}
+	}
+}
+
+// Probes every replica of the services once. The replicas are reached on their own
+// IP, which the swarm's DNS resolves from tasks.<service>, rather than through the
+// service's virtual IP. The tasks of a service with a replica that fails the probe
+// too many times in a row are replaced. The failures are counted by route across calls
+func (m *swarmManager) checkLiveness(failures map[string]int) {
+	services, err := m.listServices()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	probed := make(map[string]bool)
+	for _, svc := range services {
+		ips, err := m.lookupTasks("tasks." + svc.Spec.Name)
+		if err != nil {
+			continue // no replica is running
+		}
+
+		unhealthy := false
+		for _, ip := range ips {
+			route := net.JoinHostPort(ip, strconv.Itoa(m.port))
+			probed[route] = true
+			if err := m.liveness.check(route); err == nil {
+				delete(failures, route)
+				continue
+			}
+			if failures[route]++; failures[route] >= m.liveness.failures {
+				delete(failures, route)
+				unhealthy = true
+			}
+		}
+		if unhealthy {
+			if err := m.replaceTasks(svc); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	for route := range failures {
+		if !probed[route] {
+			delete(failures, route)
+		}
+	}
+}
+
+// Forces the swarm to replace the service's tasks. The swarm API cannot restart a
+// single task, so every replica is replaced one at a time
+func (m *swarmManager) replaceTasks(svc swarm.Service) error {
+	log.Printf("a replica of service '%s' failed its liveness probe, replacing its tasks", svc.Spec.Name)
+
+	spec := svc.Spec
+	spec.TaskTemplate.ForceUpdate++
+	if _, err := m.cli.ServiceUpdate(m.ctx, svc.ID, svc.Version, spec, types.ServiceUpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "could not replace the tasks of service: %s", svc.Spec.Name)
+	}
+	return nil
+}
+
+// Converts the limits to the service's task limits. The swarm API only limits the
+// memory and CPUs of tasks, so CPU shares, pids and open files limits are not applied
+func serviceResources(r model.Resources) *swarm.ResourceRequirements {
+	if r.Memory == 0 && r.CPUQuota == 0 {
+		return nil
+	}
+	return &swarm.ResourceRequirements{
+		Limits: &swarm.Resources{
+			NanoCPUs:    r.CPUQuota * 1e9 / cpuPeriod,
+			MemoryBytes: r.Memory,
+		},
+	}
+}
+
+func newSwarmManager() (*swarmManager, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating new Docker Client")
+	}
+
+	network := utils.StrLowerTrim(viper.GetString("deploy.network"))
+	if network == "" {
+		return nil, errors.New("deploy.network must specify the overlay network shared by warden and the services")
+	}
+
+	port := viper.GetInt("deploy.port")
+	if port <= 0 || port > 65535 {
+		return nil, errors.Errorf("deploy.port must be a valid port that the instances listen on, got %d", port)
+	}
+
+	limits, err := resourceLimitsFromViper()
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.requireNoProcessLimits("swarm"); err != nil {
+		return nil, err
+	}
+
+	m := &swarmManager{
+		routes:   newRouteMap(),
+		client:   newInstanceClient(transportConfigFromViper()),
+		ctx:      context.Background(),
+		cli:      cli,
+		network:  network,
+		port:     port,
+		liveness: probeFromViper("deploy.liveness"),
+		limits:   limits,
+		stop:     make(chan struct{}),
+
+		lookupTasks: net.LookupHost,
+	}
+	m.waitReady = probeFromViper("deploy.readiness").waitReady
+	if err := m.loadRoutes(); err != nil {
+		log.Println(err)
+	}
+	if m.liveness.interval > 0 {
+		go m.watchLiveness()
+	}
+	return m, nil
+}
@@ -0,0 +1,214 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake of the Docker API that keeps services in memory. Filters are ignored
+type fakeSwarm struct {
+	m        sync.Mutex
+	nextId   int
+	services map[string]*swarm.Service
+}
+
+func (f *fakeSwarm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1.25")
+	switch {
+	case r.Method == "GET" && path == "/services":
+		list := []swarm.Service{}
+		for _, svc := range f.services {
+			list = append(list, *svc)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "POST" && path == "/services/create":
+		var spec swarm.ServiceSpec
+		json.NewDecoder(r.Body).Decode(&spec)
+		f.nextId++
+		id := fmt.Sprintf("svc%d", f.nextId)
+		f.services[id] = &swarm.Service{ID: id, Meta: swarm.Meta{Version: swarm.Version{Index: 1}}, Spec: spec}
+		json.NewEncoder(w).Encode(types.ServiceCreateResponse{ID: id})
+	case r.Method == "POST" && strings.HasSuffix(path, "/update"):
+		svc, ok := f.services[strings.TrimSuffix(strings.TrimPrefix(path, "/services/"), "/update")]
+		if !ok {
+			http.Error(w, `{"message": "no such service"}`, http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&svc.Spec)
+		svc.Version.Index++
+		json.NewEncoder(w).Encode(types.ServiceUpdateResponse{})
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/services/"):
+		delete(f.services, strings.TrimPrefix(path, "/services/"))
+	default:
+		http.Error(w, `{"message": "not implemented"}`, http.StatusNotImplemented)
+	}
+}
+
+func newFakeSwarmManager(t *testing.T) (*swarmManager, *fakeSwarm, func()) {
+	fake := &fakeSwarm{services: make(map[string]*swarm.Service)}
+	srv := httptest.NewServer(fake)
+	cli, err := client.NewClient("tcp://"+srv.Listener.Addr().String(), "1.25", &http.Client{Transport: &http.Transport{}}, nil)
+	assert.Nil(t, err)
+
+	m := &swarmManager{
+		routes:   newRouteMap(),
+		ctx:      context.Background(),
+		cli:      cli,
+		network:  "warden",
+		port:     8080,
+		liveness: probe{path: "/healthz", timeout: time.Second, interval: 10 * time.Second, failures: 3},
+
+		waitReady: func(string) error { return nil },
+	}
+	return m, fake, srv.Close
+}
+
+func TestSwarmManager_DeployInstance(t *testing.T) {
+	m, fake, closeFn := newFakeSwarmManager(t)
+	defer closeFn()
+
+	d := Deployment{Project: "proj", Alias: "dev", Hash: "abc123", MinReplica: 2, MaxReplica: 5}
+	assert.Nil(t, m.DeployInstance(d))
+	assert.Len(t, fake.services, 1)
+
+	svc := fake.services["svc1"]
+	assert.Equal(t, "warden-proj-dev-abc123", svc.Spec.Name)
+	assert.Equal(t, uint64(2), *svc.Spec.Mode.Replicated.Replicas)
+	assert.Equal(t, "5", svc.Spec.Labels[labelMaxReplica])
+	assert.Equal(t, "proj/dev", svc.Spec.Labels[labelAddress])
+	assert.Equal(t, "warden", svc.Spec.TaskTemplate.Networks[0].Target)
+	assert.Equal(t, "warden-proj-dev-abc123:8080", m.routes.Get("proj/dev"))
+
+	// the image's own healthcheck is disabled as the warden probes the replicas
+	health := svc.Spec.TaskTemplate.ContainerSpec.Healthcheck
+	if assert.NotNil(t, health) {
+		assert.Equal(t, []string{"NONE"}, health.Test)
+	}
+
+	// deploying again updates the existing service
+	d.MinReplica = 3
+	assert.Nil(t, m.DeployInstance(d))
+	assert.Len(t, fake.services, 1)
+	assert.Equal(t, uint64(3), *svc.Spec.Mode.Replicated.Replicas)
+	assert.Equal(t, uint64(2), svc.Version.Index)
+}
+
+func TestSwarmManager_DeployInstanceRefusesSecrets(t *testing.T) {
+	m, fake, closeFn := newFakeSwarmManager(t)
+	defer closeFn()
+
+	d := Deployment{Project: "proj", Alias: "dev", Hash: "abc123", MinReplica: 1, MaxReplica: 1}
+	d.Env = map[string]string{"LOG_LEVEL": "debug", "API_TOKEN": "s3cr3t", "DB_PASSWORD": "pa55"}
+	d.Secrets = []string{"API_TOKEN", "DB_PASSWORD"}
+	assert.EqualError(t, m.DeployInstance(d), "secret environment variables are not supported on swarm as they would be stored in plain text in the service's spec. Set API_TOKEN, DB_PASSWORD as plain variables instead")
+	assert.Len(t, fake.services, 0)
+}
+
+func TestSwarmManager_StopInstance(t *testing.T) {
+	m, fake, closeFn := newFakeSwarmManager(t)
+	defer closeFn()
+
+	old := Deployment{Project: "proj", Hash: "abc123"}
+	replacement := Deployment{Project: "proj", Hash: "def456"}
+	assert.Nil(t, m.DeployInstance(old))
+	assert.Nil(t, m.DeployInstance(replacement))
+
+	// stopping the replaced deployment does not unroute its successor
+	assert.Nil(t, m.StopInstance(old))
+	assert.Len(t, fake.services, 1)
+	assert.Equal(t, "warden-proj-latest-def456:8080", m.routes.Get("proj"))
+
+	assert.Nil(t, m.StopInstance(replacement))
+	assert.Len(t, fake.services, 0)
+	assert.Equal(t, "", m.routes.Get("proj"))
+
+	// stopping a missing deployment does nothing
+	assert.Nil(t, m.StopInstance(replacement))
+}
+
+func TestSwarmManager_LoadRoutes(t *testing.T) {
+	m, fake, closeFn := newFakeSwarmManager(t)
+	defer closeFn()
+
+	assert.Nil(t, m.DeployInstance(Deployment{Project: "proj", Alias: "dev", Hash: "abc123"}))
+	fake.services["other"] = &swarm.Service{ID: "other", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "not-warden"}}}
+
+	m.routes = newRouteMap()
+	assert.Nil(t, m.loadRoutes())
+	assert.Equal(t, "warden-proj-dev-abc123:8080", m.routes.Get("proj/dev"))
+	assert.Equal(t, "", m.routes.Get("not-warden"))
+}
+
+func TestSwarmManager_Reconcile(t *testing.T) {
+	m, fake, closeFn := newFakeSwarmManager(t)
+	defer closeFn()
+
+	kept := Deployment{Project: "proj", Alias: "dev", Hash: "abc123"}
+	stray := Deployment{Project: "proj", Alias: "old", Hash: "abc123"}
+	missing := Deployment{Project: "other", Hash: "def456"}
+	assert.Nil(t, m.DeployInstance(kept))
+	assert.Nil(t, m.DeployInstance(stray))
+	fake.services["other"] = &swarm.Service{ID: "other", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "not-warden"}}}
+
+	m.routes = newRouteMap()
+	assert.Nil(t, m.Reconcile([]Deployment{kept, missing}))
+
+	var names []string
+	for _, svc := range fake.services {
+		names = append(names, svc.Spec.Name)
+	}
+	assert.ElementsMatch(t, []string{"warden-proj-dev-abc123", "warden-other-latest-def456", "not-warden"}, names)
+	assert.Equal(t, "warden-proj-dev-abc123:8080", m.routes.Get("proj/dev"))
+	assert.Equal(t, "warden-other-latest-def456:8080", m.routes.Get("other"))
+	assert.Equal(t, "", m.routes.Get("proj/old"))
+}
+
+func TestSwarmManager_CheckLiveness(t *testing.T) {
+	m, fake, closeFn := newFakeSwarmManager(t)
+	defer closeFn()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	assert.Nil(t, err)
+	m.port, _ = strconv.Atoi(port)
+	m.liveness = probe{path: "/healthz", timeout: time.Second, failures: 2}
+	m.lookupTasks = func(name string) ([]string, error) {
+		if name == "tasks.warden-proj-dev-abc123" {
+			return []string{host}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	assert.Nil(t, m.DeployInstance(Deployment{Project: "proj", Alias: "dev", Hash: "abc123"}))
+	svc := fake.services["svc1"]
+	failures := make(map[string]int)
+	m.checkLiveness(failures)
+	assert.Empty(t, failures)
+
+	// the tasks are replaced once a replica fails the probe often enough
+	srv.Close()
+	m.checkLiveness(failures)
+	assert.Equal(t, uint64(0), svc.Spec.TaskTemplate.ForceUpdate)
+	m.checkLiveness(failures)
+	assert.Equal(t, uint64(1), svc.Spec.TaskTemplate.ForceUpdate)
+	assert.Empty(t, failures)
+}
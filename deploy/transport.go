@@ -0,0 +1,79 @@
+package deploy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Settings of the connections to the instances
+type transportConfig struct {
+	maxIdleConns          int           // idle connections kept across all instances
+	maxIdleConnsPerHost   int           // idle connections kept to each replica
+	maxConnsPerHost       int           // connections open to each replica at once. 0 for no limit
+	idleConnTimeout       time.Duration // time an idle connection is kept open
+	dialTimeout           time.Duration // time a connection has to be established
+	keepAlive             time.Duration // interval of the TCP keep-alive probes
+	tlsHandshakeTimeout   time.Duration // time the TLS handshake has to complete
+	responseHeaderTimeout time.Duration // time an instance has to start responding
+}
+
+// Creates the client that forwards requests to the instances. The client is shared by
+// every request so that connections to the replicas are kept alive and reused. It
+// holds no cookie jar as the requests of every caller go through it, cookies are
+// passed on as the headers of each request and response.
+//
+// There is no limit on the time taken to read the response once the instance has
+// started responding, as instances may stream their response. Redirects are not
+// followed so that the caller receives the instance's status and Location header, and
+// no proxy is used as the instances are reached directly
+func newInstanceClient(config transportConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   config.dialTimeout,
+		KeepAlive: config.keepAlive,
+	}
+	return &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          config.maxIdleConns,
+			MaxIdleConnsPerHost:   config.maxIdleConnsPerHost,
+			MaxConnsPerHost:       config.maxConnsPerHost,
+			IdleConnTimeout:       config.idleConnTimeout,
+			TLSHandshakeTimeout:   config.tlsHandshakeTimeout,
+			ResponseHeaderTimeout: config.responseHeaderTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+// Reads the settings of the connections to the instances from the config
+func transportConfigFromViper() transportConfig {
+	intOr := func(key string, def int) int {
+		if viper.IsSet(key) {
+			return viper.GetInt(key)
+		}
+		return def
+	}
+	durationOr := func(key string, def time.Duration) time.Duration {
+		if d := viper.GetDuration(key); d > 0 {
+			return d
+		}
+		return def
+	}
+
+	return transportConfig{
+		maxIdleConns:          intOr("deploy.transport.max_idle_conns", 100),
+		maxIdleConnsPerHost:   intOr("deploy.transport.max_idle_conns_per_host", 32),
+		maxConnsPerHost:       intOr("deploy.transport.max_conns_per_host", 0),
+		idleConnTimeout:       durationOr("deploy.transport.idle_conn_timeout", 90*time.Second),
+		dialTimeout:           durationOr("deploy.transport.dial_timeout", 5*time.Second),
+		keepAlive:             durationOr("deploy.transport.keep_alive", 30*time.Second),
+		tlsHandshakeTimeout:   durationOr("deploy.transport.tls_handshake_timeout", 5*time.Second),
+		responseHeaderTimeout: durationOr("deploy.transport.response_header_timeout", 5*time.Minute),
+	}
+}
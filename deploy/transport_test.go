@@ -0,0 +1,61 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceClient(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "server-set"})
+		c, err := r.Cookie("session")
+		if err == nil {
+			w.Write([]byte(c.Value))
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	routes := newRouteMap()
+	routes.Set("proj", strings.TrimPrefix(srv.URL, "http://"))
+	c := newInstanceClient(transportConfigFromViper())
+	run := func(cookie string) string {
+		r := newExecRequest("proj", "latest")
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+		}
+		resp, err := runInstance(c, routes, r)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+
+	// the caller's cookies are passed on, the instance's are not kept for other callers
+	assert.Equal(t, "alice", run("alice"))
+	assert.Equal(t, "", run(""))
+	assert.Equal(t, "bob", run("bob"))
+
+	// the connection is kept alive between requests
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestTransportConfigFromViper(t *testing.T) {
+	config := transportConfigFromViper()
+	assert.Equal(t, 32, config.maxIdleConnsPerHost)
+	assert.True(t, config.responseHeaderTimeout > 0)
+	assert.True(t, config.dialTimeout > 0)
+}
@@ -29,11 +29,18 @@ type Client struct {
 	cli   *client.Client
 	ctx   context.Context
 	hub   *registry.Registry
+	queue *buildQueue
 	redis *redis.Client
 }
 
 const (
 	redisContainer = "warden_redis"
+
+	// Label marking the helper containers started by warden with their role. The
+	// containers are found by this label, or by their name if they were started by a
+	// version of warden that did not label them
+	labelRole = "warden.role"
+	roleRedis = "redis"
 )
 
 var (
@@ -72,7 +79,7 @@ func NewClient() (*Client, error) {
 			}
 		}
 
-		dockerClient := &Client{
+		dockerClient = &Client{
 			cli: c,
 			ctx: ctx,
 			hub: hub,
@@ -80,6 +87,10 @@ func NewClient() (*Client, error) {
 		if err := dockerClient.startRedis(); err != nil {
 			dockerClientError = errors.Wrap(err, "error creating Docker Client")
 		}
+		dockerClient.queue = newBuildQueue(
+			dockerClient.BuildImage,
+			viper.GetInt("build.workers"),
+			viper.GetInt("build.project_concurrency"))
 	})
 
 	return dockerClient, dockerClientError
@@ -124,8 +135,9 @@ func (c *Client) startRedis() error {
 	return nil
 }
 
-// Teardowns the Client object properly
+// Teardowns the Client object properly. Builds waiting in the queue are dropped
 func (c *Client) Close() (err error) {
+	c.queue.close()
 	if viper.GetBool("redis.remove_on_exit") {
 		err = c.removeRedis()
 	} else {
@@ -156,44 +168,73 @@ func (c *Client) Close() (err error) {
 
 // Kills and remove the redis container if it exists
 func (c *Client) removeRedis() error {
-	// search for containers with the defined redis container name
-	ftr := filters.NewArgs()
-	ftr.Add("name", redisContainer)
-	containers, _ := c.cli.ContainerList(
-		c.ctx,
-		types.ContainerListOptions{
-			Filters: ftr,
-			All:     true})
+	containers, err := c.listRedis()
+	if err != nil {
+		return err
+	}
 
 	// if container exist (there should only be 1), remove it
-	if len(redisContainer) > 0 {
-		for _, con := range containers {
-			if err := c.cli.ContainerRemove(c.ctx, con.ID, types.ContainerRemoveOptions{
-				Force: true,
-			}); err != nil {
-				return errors.Wrap(err, "error removing Redis container")
-			}
+	for _, con := range containers {
+		if err := c.cli.ContainerRemove(c.ctx, con.ID, types.ContainerRemoveOptions{
+			Force: true,
+		}); err != nil {
+			return errors.Wrap(err, "error removing Redis container")
 		}
 	}
 	return nil
 }
 
+// Lists the redis containers started by warden. Containers started before they were
+// labelled are found by their name. Docker cannot label an existing container, so
+// these are adopted as they are
+func (c *Client) listRedis() ([]types.Container, error) {
+	byLabel := filters.NewArgs()
+	byLabel.Add("label", labelRole+"="+roleRedis)
+	byName := filters.NewArgs()
+	byName.Add("name", "^/"+redisContainer+"$")
+
+	var containers []types.Container
+	found := make(map[string]bool)
+	for _, ftr := range []filters.Args{byLabel, byName} {
+		list, err := c.cli.ContainerList(
+			c.ctx,
+			types.ContainerListOptions{
+				Filters: ftr,
+				All:     true})
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing Redis containers")
+		}
+		for _, con := range list {
+			if !found[con.ID] {
+				found[con.ID] = true
+				containers = append(containers, con)
+			}
+		}
+	}
+	return containers, nil
+}
+
 // Starts a new redis container
 func (c *Client) runRedisContainer() error {
 	redisImage := viper.GetString("redis.image")
 	redisHost := viper.GetString("redis.addr")
 	redisPort := viper.GetString("redis.port")
 
-	ftr := filters.NewArgs()
-	ftr.Add("name", redisContainer)
-	containers, _ := c.cli.ContainerList(
-		c.ctx,
-		types.ContainerListOptions{
-			Filters: ftr,
-			All:     true})
+	containers, err := c.listRedis()
+	if err != nil {
+		return err
+	}
 
+	// the existing container is started again if it was stopped
 	if len(containers) > 0 {
-		log.Println("Instance of redis already running")
+		if containers[0].State == "running" {
+			log.Println("Instance of redis already running")
+			return nil
+		}
+		log.Println("starting existing redis container")
+		if err := c.cli.ContainerStart(c.ctx, containers[0].ID, types.ContainerStartOptions{}); err != nil {
+			return errors.Wrap(err, "error starting Redis container")
+		}
 		return nil
 	}
 
@@ -203,6 +244,7 @@ func (c *Client) runRedisContainer() error {
 		&container.Config{
 			Image:        redisImage,
 			ExposedPorts: nat.PortSet{nat.Port(redisPort): struct{}{}},
+			Labels:       map[string]string{labelRole: roleRedis},
 		},
 		&container.HostConfig{
 			PortBindings: map[nat.Port][]nat.PortBinding{nat.Port(redisPort): {{HostIP: redisHost, HostPort: redisPort}}},
@@ -1,26 +1,112 @@
 package docker
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/alicebob/miniredis"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/assert"
 
 	"warden/config"
 )
 
-var cli *Client
-
 func init() {
 	config.ReadConfig()
-	_cli, err := NewClient()
+}
+
+// Gets the Docker client. Skips the test if the Docker daemon or any of the services
+// the client depends on can't be reached
+func testClient(t *testing.T) *Client {
+	cli, err := NewClient()
 	if err != nil {
-		log.Fatalln(err)
+		t.Skipf("Docker client unavailable: %s", err)
+	}
+	return cli
+}
+
+// Starts an in-memory Redis server for the test and connects to it. The returned
+// function stops the server
+func testRedis(t *testing.T) (*redis.Client, func()) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	return r, func() {
+		r.Close()
+		srv.Close()
 	}
-	cli = _cli
 }
 
 func TestNewClient(t *testing.T) {
+	testClient(t)
 	_, err := NewClient()
 	assert.Nil(t, err)
 }
+
+// A fake of the Docker API that lists and starts containers kept in memory. Only the
+// label and name filters are applied
+type fakeDocker struct {
+	m          sync.Mutex
+	containers []types.Container
+	started    []string
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1.25")
+	switch {
+	case r.Method == "GET" && path == "/containers/json":
+		ftr, err := filters.FromParam(r.URL.Query().Get("filters"))
+		if err != nil {
+			http.Error(w, `{"message": "invalid filters"}`, http.StatusBadRequest)
+			return
+		}
+		containers := []types.Container{}
+		for _, con := range f.containers {
+			if ftr.MatchKVList("label", con.Labels) && (!ftr.Include("name") || ftr.Match("name", con.Names[0])) {
+				containers = append(containers, con)
+			}
+		}
+		json.NewEncoder(w).Encode(containers)
+	case r.Method == "POST" && strings.HasSuffix(path, "/start"):
+		f.started = append(f.started, strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/start"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"message": "not implemented"}`, http.StatusNotImplemented)
+	}
+}
+
+func TestClient_RunRedisContainerAdoptsUnlabelled(t *testing.T) {
+	fake := &fakeDocker{containers: []types.Container{
+		{ID: "other", Names: []string{"/warden_redis_old"}, State: "running"},
+		// started before the redis container was labelled
+		{ID: "redis", Names: []string{"/" + redisContainer}, State: "exited"},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cli, err := client.NewClient("tcp://"+srv.Listener.Addr().String(), "1.25", &http.Client{Transport: &http.Transport{}}, nil)
+	assert.Nil(t, err)
+	c := &Client{cli: cli, ctx: context.Background()}
+
+	containers, err := c.listRedis()
+	assert.Nil(t, err)
+	if assert.Len(t, containers, 1) {
+		assert.Equal(t, "redis", containers[0].ID)
+	}
+
+	// the stopped container is started rather than created again under the same name
+	assert.Nil(t, c.runRedisContainer())
+	assert.Equal(t, []string{"redis"}, fake.started)
+}
@@ -13,7 +13,6 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"gopkg.in/src-d/go-git.v4"
@@ -24,6 +23,12 @@ import (
 	"warden/utils"
 )
 
+// Stages of an image build reported through ImageBuildOptions.OnStage
+const (
+	StageBuilding = "building"
+	StagePushing  = "pushing"
+)
+
 // Standardized options for building function images. One should ensure that
 // the username and password / access token provided has the authority to
 // clone the repository
@@ -36,7 +41,13 @@ type ImageBuildOptions struct {
 	RunEnv   string // Run time environment. i.e. Python
 	Handler  string // Handler specifies the file and function that serves as the entrypoint. i.e. main.entry_func
 	Alias    string // Alias for the function run
-	buildId  string // Internal ID used to track whether image is getting built
+
+	BaseImage string             // Overrides the base image of the runtime environment's template. Optional
+	BuildArgs map[string]string  // Build arguments passed to the image build. Optional
+	OnStage   func(stage string) // Called when the build moves to a new stage, i.e. StagePushing. Optional
+	OnLog     func(LogEntry)     // Receives the build and push output as it arrives. Logged if not given
+
+	buildId string // Internal ID used as the key of the build's lock
 }
 
 // ImagePullOptions holds information to pull images.
@@ -46,7 +57,9 @@ type ImagePullOptions struct {
 }
 
 type templateDetails struct {
-	Handler string
+	BaseImage string
+	BuildArgs map[string]string
+	Handler   string
 }
 
 var box *templates.Box
@@ -59,70 +72,67 @@ func init() {
 	box = _box
 }
 
-// Builds the image specified in the ImageBuildOptions. In normal circumstances,
-// you should run this as a go routine.
-func (c *Client) BuildImage(options ImageBuildOptions) error {
-	// validations
+// Builds the image specified in the ImageBuildOptions and pushes it to the private
+// registry. The call blocks until the image is available in the registry, thus in
+// normal circumstances, you should use QueueBuild instead. Returns the full commit
+// hash that the image is tagged with.
+func (c *Client) BuildImage(options ImageBuildOptions) (string, error) {
+	// validations. Username is not required as public repositories can be cloned
+	// without credentials
 	if utils.StrIsEmptyOrWhitespace(options.Handler) {
-		return errors.New("handler must be specified")
+		return "", errors.New("handler must be specified")
 	} else if utils.StrIsEmptyOrWhitespace(options.RunEnv) {
-		return errors.New("RunEnv (runtime environment) must be specified")
-	} else if utils.StrIsEmptyOrWhitespace(options.Username) {
-		return errors.New("username must be specified")
+		return "", errors.New("RunEnv (runtime environment) must be specified")
 	} else if utils.StrIsEmptyOrWhitespace(options.GitURL) {
-		return errors.New("Repository (Git) url must be specified")
+		return "", errors.New("Repository (Git) url must be specified")
 	} else if utils.StrIsEmptyOrWhitespace(options.Name) {
-		return errors.New("project name must be specified")
+		return "", errors.New("project name must be specified")
 	}
 	options.Name = utils.StrLowerTrim(options.Name)
-	options.Hash = utils.StrLowerTrim(options.Hash)
-	options.buildId = utils.StrLowerTrim(fmt.Sprintf("%s-%s", options.GitURL, options.Hash))
 
-	if !utils.StrIsEmptyOrWhitespace(options.Hash) {
-		if hasTag, err := c.hubHasImage(options.Name, options.Hash); err != nil {
-			log.Println(err)
-		} else if hasTag {
-			log.Printf("image '%s:%s' already exists", options.Name, options.Hash)
-			return nil // image exists in repository. Skip
-		}
+	// Creating a temp folder to house the image build artifacts
+	dir, err := ioutil.TempDir(os.TempDir(), options.Name+"-")
+	if err != nil {
+		return "", errors.Wrap(err, "error creating temp dir for cloning when building image")
 	}
+	defer os.RemoveAll(dir)
 
-	// Should probably set a lock here, but I don't foresee that kind of traffic
-	res := c.redis.Get(options.buildId)
-	if res.Err() != redis.Nil {
-		// there is a similar image current building. Skip
-		log.Printf("image '%s:%s' already building", options.Name, options.Hash)
-		return nil
+	// The commit is resolved before taking the lock so that builds asked for with a
+	// short hash, the full hash or "latest" all wait on the same lock
+	repo, err := cloneRepo(dir, options)
+	if err != nil {
+		return "", err
 	}
+	if options.Hash, err = resolveCommit(repo, options.Hash); err != nil {
+		return "", err
+	}
+	options.buildId = utils.StrLowerTrim(fmt.Sprintf("warden:build:%s-%s", options.GitURL, options.Hash))
 
-	// default build time: 10 minutes
-	c.redis.Set(options.buildId, fmt.Sprintf("Building image: %s", options.buildId), 10*time.Minute)
-
-	// build image
-	go func() {
-		err := c.buildImage(options)
-		if err != nil {
-			c.redis.Set(
-				options.buildId,
-				fmt.Sprintf("Image build '%s' resulted in error. Check build again. If local build succeeded, it may mean that image build took more than 10 minutes (timeout error)", options.buildId),
-				24*time.Hour)
+	// Only one build of the GitURL and hash may run at a time, across all replicas. If
+	// another build holds the lock, wait for it and use its image
+	lock, err := c.lockBuild(options)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
 			log.Println(err)
 		}
 	}()
 
-	return nil
-}
-
-func (c *Client) buildImage(options ImageBuildOptions) error {
-	// Cloning and checking out repository portion
-	// Creating a temp folder to house the image build artifacts
-	dir, err := ioutil.TempDir(os.TempDir(), options.Name+"-"+options.Hash)
-	defer os.RemoveAll(dir)
-	if err != nil {
-		return errors.Wrap(err, "error creating temp dir for cloning when building image")
+	if tag, err := c.hubFindTag(options.Name, options.Hash); err != nil {
+		log.Println(err)
+	} else if tag != "" {
+		log.Printf("image '%s:%s' already exists", options.Name, tag)
+		return tag, nil // image exists in repository. Skip
 	}
+	options.stage(StageBuilding)
+
+	return c.buildImage(lock, dir, repo, options)
+}
 
-	// Clone the repo into the temp folder
+// Clones the repository into the directory
+func cloneRepo(dir string, options ImageBuildOptions) (*git.Repository, error) {
 	user := options.Username
 	pw := options.Password
 	if utils.StrIsEmptyOrWhitespace(options.Password) {
@@ -139,84 +149,131 @@ func (c *Client) buildImage(options ImageBuildOptions) error {
 		URL:      options.GitURL,
 		Progress: os.Stdout,
 	})
-
 	if err != nil {
-		return errors.Wrapf(err, "error cloning repo when building image. \n\tURL: %s. \n\tUsername: %s",
+		return nil, errors.Wrapf(err, "error cloning repo when building image. \n\tURL: %s. \n\tUsername: %s",
 			options.GitURL, options.Username)
 	}
+	return repo, nil
+}
 
-	// Prepare the hash for the right checkout. If hash provided is an empty string or "latest",
-	// Will checkout the latest commit
-	options.Hash = utils.StrLowerTrim(options.Hash)
+// Resolves the hash to the full hash of the commit it prefixes. If hash is an empty
+// string or "latest", resolves to the latest commit
+func resolveCommit(repo *git.Repository, hash string) (string, error) {
+	hash = utils.StrLowerTrim(hash)
 	commits, err := repo.CommitObjects()
 	if err != nil {
-		return errors.Wrap(err, "error getting repo commits")
+		return "", errors.Wrap(err, "error getting repo commits")
 	}
 
-	if utils.StrIn(options.Hash, nil, "", "latest") {
+	if utils.StrIn(hash, nil, "", "latest") {
 		commit, err := commits.Next()
 		if err != nil {
-			return errors.Wrap(err, "error getting latest commit when building image")
+			return "", errors.Wrap(err, "error getting latest commit when building image")
 		}
-		options.Hash = commit.Hash.String()
-	} else {
-		for {
-			c, err := commits.Next()
-			if err == io.EOF {
-				return errors.Wrapf(err, "could not find commit prefixed with hash '%s'", options.Hash)
-			} else if err != nil {
-				return errors.Wrap(err, "error reading commit history")
-			}
-			if strings.HasPrefix(c.Hash.String(), options.Hash) {
-				options.Hash = c.Hash.String()
-				break
-			}
+		return commit.Hash.String(), nil
+	}
+	for {
+		c, err := commits.Next()
+		if err == io.EOF {
+			return "", errors.Wrapf(err, "could not find commit prefixed with hash '%s'", hash)
+		} else if err != nil {
+			return "", errors.Wrap(err, "error reading commit history")
+		}
+		if strings.HasPrefix(c.Hash.String(), hash) {
+			return c.Hash.String(), nil
 		}
 	}
+}
 
-	if hasTag, err := c.hubHasImage(options.Name, options.Hash); err != nil {
-		log.Println(err)
-	} else if hasTag {
-		return nil // image exists, skip
+// Acquires the build lock of the image. Blocks while another build holds the lock
+func (c *Client) lockBuild(options ImageBuildOptions) (*redisLock, error) {
+	ttl := viper.GetDuration("build.lock_ttl")
+	if ttl <= 0 {
+		ttl = 30 * time.Second
 	}
 
+	waiting := false
+	for {
+		lock, err := acquireLock(c.redis, options.buildId, ttl)
+		if err == nil {
+			return lock, nil
+		} else if errors.Cause(err) != ErrLockHeld {
+			return nil, err
+		}
+
+		if !waiting {
+			log.Printf("image '%s:%s' already building, waiting for it to complete", options.Name, options.Hash)
+			waiting = true
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Queues the image build. The build is run with BuildImage by the next free worker
+// and done is called with its result. At most "build.workers" builds run at once and
+// at most "build.project_concurrency" of them may be of the same project. The id
+// identifies the build when asking for its position in the queue.
+func (c *Client) QueueBuild(id string, options ImageBuildOptions, done func(hash string, err error)) error {
+	return c.queue.enqueue(&buildJob{id: id, options: options, done: done})
+}
+
+// Gets the position of the build in the queue, starting from 1 for the build that is
+// next in line. Returns 0 if the build is not waiting, i.e. it is already running
+func (c *Client) QueuePosition(id string) int {
+	return c.queue.position(id)
+}
+
+// Builds the cloned repository at the resolved commit and pushes the image while
+// holding the build lock. The build is aborted if the lease on the lock is lost so
+// that it does not race the next owner
+func (c *Client) buildImage(lock *redisLock, dir string, repo *git.Repository, options ImageBuildOptions) (string, error) {
 	// Checkout the hash specified
 	tree, err := repo.Worktree()
 	if err != nil {
-		return errors.Wrap(err, "error getting worktree when building image")
+		return "", errors.Wrap(err, "error getting worktree when building image")
 	}
 
 	if err := tree.Checkout(&git.CheckoutOptions{
 		Hash: plumbing.NewHash(options.Hash),
 	}); err != nil {
-		return errors.Wrapf(err, "error checkout commit hash '%s' when building image", options.Hash)
+		return "", errors.Wrapf(err, "error checkout commit hash '%s' when building image", options.Hash)
 	}
 
 	// Create template Dockerfile in temp directory
-	err = prepareDockerfileTemplate(dir, options.RunEnv, options.Handler)
+	err = prepareDockerfileTemplate(dir, options.RunEnv, templateDetails{
+		BaseImage: options.BaseImage,
+		BuildArgs: options.BuildArgs,
+		Handler:   options.Handler,
+	})
 	if err != nil {
-		return errors.Wrap(err, "error when building image")
+		return "", errors.Wrap(err, "error when building image")
 	}
 
 	tagName := formRegistryTag(options.Name, options.Hash)
 
 	tarDir, err := utils.TarDir(dir, tagName, &utils.TarDirOption{RemoveIfExist: true})
 	if err != nil {
-		return errors.Wrap(err, "error encountered when tarring payload for docker build context")
+		return "", errors.Wrap(err, "error encountered when tarring payload for docker build context")
 	}
 
 	tarDir, _ = filepath.Abs(tarDir)
 	defer os.Remove(tarDir)
 	tarfile, err := os.Open(tarDir)
 	if err != nil {
-		return errors.Wrap(err, "error encountered when reading tarfile")
+		return "", errors.Wrap(err, "error encountered when reading tarfile")
 	}
 	defer tarfile.Close()
 
 	// Preparing to build the image
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(lock.Context(), 10*time.Minute)
 	defer cancel()
 
+	buildArgs := make(map[string]*string, len(options.BuildArgs))
+	for name := range options.BuildArgs {
+		value := options.BuildArgs[name]
+		buildArgs[name] = &value
+	}
+
 	// Build the image
 	if resp, err := c.cli.ImageBuild(ctx, tarfile, types.ImageBuildOptions{
 		SuppressOutput: false,
@@ -224,29 +281,45 @@ func (c *Client) buildImage(options ImageBuildOptions) error {
 		ForceRemove:    true,
 		PullParent:     true,
 		Tags:           []string{tagName},
+		BuildArgs:      buildArgs,
 	}); err != nil {
-		return errors.Wrap(err, "error encountered when building image")
+		return "", errors.Wrap(err, "error encountered when building image")
 	} else {
 		defer resp.Body.Close()
-		streamResponse(resp.Body)
+		if err := streamResponse(resp.Body, LogStreamBuild, options.OnLog); err != nil {
+			return "", errors.Wrap(err, "error encountered when building image")
+		}
 	}
 
-	// Push image to local registry.
+	// Push image to local registry. Only the owner of the lock may push, which is
+	// confirmed with Redis right before the push
+	if err := lock.Check(); err != nil {
+		return "", errors.Wrap(err, "build aborted before pushing image")
+	}
+	options.stage(StagePushing)
 	if resp, err := c.cli.ImagePush(
-		c.ctx,
+		ctx,
 		tagName,
 		types.ImagePushOptions{
-			RegistryAuth: `Base64Encode{"username":username,"password":password}`,
+			RegistryAuth: registryAuth(),
 		},
 	); err != nil {
-		return errors.Wrap(err, "error encountered when pushing image to (private) registry")
+		return "", errors.Wrap(err, "error encountered when pushing image to (private) registry")
 	} else {
 		defer resp.Close()
-		streamResponse(resp)
+		if err := streamResponse(resp, LogStreamPush, options.OnLog); err != nil {
+			return "", errors.Wrap(err, "error encountered when pushing image to (private) registry")
+		}
 	}
 
-	c.redis.Del(options.buildId)
-	return nil
+	return options.Hash, nil
+}
+
+// Reports the stage of the build if a callback was given
+func (o *ImageBuildOptions) stage(stage string) {
+	if o.OnStage != nil {
+		o.OnStage(stage)
+	}
 }
 
 func (c *Client) ListImages() ([]types.ImageSummary, error) {
@@ -298,33 +371,30 @@ func (c *Client) PullImage(name string, options *ImagePullOptions) error {
 		return err
 	}
 	defer resp.Close()
-	streamResponse(resp)
 
-	return nil
+	return streamResponse(resp, LogStreamPull, nil)
 }
 
-func prepareDockerfileTemplate(dir, env, handler string) error {
+// Writes the Dockerfile for the runtime environment into the directory. The runtime
+// environment is the name of the template in the templates Box
+func prepareDockerfileTemplate(dir, env string, data templateDetails) error {
+	env = utils.StrLowerTrim(env)
+	if !box.HasTemplate(env) {
+		return errors.Errorf("Unknown runtime environment: %s", env)
+	}
+	tpl, err := box.GetTemplate(env)
+	if err != nil {
+		return err
+	}
+
 	file, err := os.Create(filepath.Join(dir, "Dockerfile"))
 	if err != nil {
 		return errors.Wrap(err, "error creating dockerfile template")
 	}
-	data := templateDetails{
-		Handler: handler,
-	}
-
-	switch utils.StrLowerTrim(env) {
-	case "python", "python3":
-		tpl, err := box.GetTemplate("python")
-		if err != nil {
-			return err
-		}
+	defer file.Close()
 
-		if err := tpl.Execute(file, data); err != nil {
-			return errors.Wrap(err, "error writing template dockerfile")
-		}
-	default:
-		return errors.Errorf("Unknown runtime environment: %s", env)
+	if err := tpl.Execute(file, data); err != nil {
+		return errors.Wrap(err, "error writing template dockerfile")
 	}
-
 	return nil
 }
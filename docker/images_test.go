@@ -1,6 +1,14 @@
 package docker
 
-import "log"
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func ExampleClient_FindImageByName() {
 	cli, _ := NewClient()
@@ -16,3 +24,19 @@ func ExampleClient_FindImageByName() {
 		log.Fatalln(err)
 	}
 }
+
+func TestPrepareDockerfileTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// runtimes stored under an alias still build with their template
+	for _, env := range []string{"python", " Python3 "} {
+		assert.Nil(t, prepareDockerfileTemplate(dir, env, templateDetails{Handler: "main.handler"}))
+		content, err := ioutil.ReadFile(filepath.Join(dir, "Dockerfile"))
+		assert.Nil(t, err)
+		assert.Contains(t, string(content), "ENV HANDLER=main.handler")
+	}
+
+	assert.EqualError(t, prepareDockerfileTemplate(dir, "cobol", templateDetails{}), "Unknown runtime environment: cobol")
+}
@@ -0,0 +1,163 @@
+package docker
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// Returned by acquireLock when the lock is held by another owner
+var ErrLockHeld = errors.New("lock is held by another owner")
+
+var (
+	// Extends the lease only if the lock is still held by the owner's token
+	renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	// Removes the lock only if it is still held by the owner's token
+	releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
+// A lease on a Redis key that is held by a single owner at a time, across all warden
+// replicas sharing the Redis server. The lease is kept alive by a heartbeat for as long
+// as the owner holds the lock, so a long running owner never loses it to the TTL while
+// the lock of an owner that crashed expires after one TTL.
+//
+// Each acquisition gets a fencing token that is larger than that of every previous
+// owner of the lock and is held as the key's value. Check compares the token with the
+// key's value in Redis, so an owner that lost the lease is told so before it acts on
+// what it guards. The lock's context is also cancelled if the heartbeat finds the
+// lease lost, i.e. because Redis could not be reached in time, so that the owner stops
+// its work before a new owner takes over.
+type redisLock struct {
+	redis  *redis.Client
+	key    string
+	token  int64
+	ttl    time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Acquires the lock on the key. Returns ErrLockHeld if the lock is held by another
+// owner. The lease is renewed every third of the ttl until the lock is released
+func acquireLock(r *redis.Client, key string, ttl time.Duration) (*redisLock, error) {
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	// The fencing counter outlives the locks so that tokens keep increasing
+	fence := key + ":fence"
+	token, err := r.Incr(fence).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting fencing token for lock '%s'", key)
+	}
+	r.Expire(fence, 24*time.Hour)
+
+	ok, err := r.SetNX(key, token, ttl).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error acquiring lock '%s'", key)
+	} else if !ok {
+		return nil, errors.Wrapf(ErrLockHeld, "could not acquire lock '%s'", key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &redisLock{
+		redis:  r,
+		key:    key,
+		token:  token,
+		ttl:    ttl,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go l.heartbeat()
+	return l, nil
+}
+
+// The fencing token of this acquisition of the lock
+func (l *redisLock) Token() int64 {
+	return l.token
+}
+
+// Context that is cancelled when the lock is released or the lease is lost
+func (l *redisLock) Context() context.Context {
+	return l.ctx
+}
+
+// Returns an error if the lease on the lock has been lost or the lock was released.
+// The token is compared with the key's value in Redis and the lease is renewed in the
+// same step, so the owner has a full ttl to act once the check passes
+func (l *redisLock) Check() error {
+	select {
+	case <-l.ctx.Done():
+		return errors.Errorf("lease on lock '%s' with token %d was lost", l.key, l.token)
+	default:
+	}
+
+	renewed, err := renewScript.Run(
+		l.redis,
+		[]string{l.key},
+		strconv.FormatInt(l.token, 10),
+		int64(l.ttl/time.Millisecond)).Int64()
+	if err != nil {
+		return errors.Wrapf(err, "error checking lock '%s'", l.key)
+	} else if renewed == 0 {
+		l.cancel()
+		return errors.Errorf("lease on lock '%s' with token %d was lost", l.key, l.token)
+	}
+	return nil
+}
+
+// Stops the heartbeat and releases the lock if it is still held by this owner
+func (l *redisLock) Release() error {
+	select {
+	case <-l.done:
+		return nil // already released
+	default:
+	}
+	close(l.done)
+	l.cancel()
+
+	if err := releaseScript.Run(l.redis, []string{l.key}, strconv.FormatInt(l.token, 10)).Err(); err != nil {
+		return errors.Wrapf(err, "error releasing lock '%s'", l.key)
+	}
+	return nil
+}
+
+func (l *redisLock) heartbeat() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			renewed, err := renewScript.Run(
+				l.redis,
+				[]string{l.key},
+				strconv.FormatInt(l.token, 10),
+				int64(l.ttl/time.Millisecond)).Int64()
+			if err == nil && renewed == 0 || err != nil && time.Since(renewedAt) >= l.ttl {
+				// the lock expired or was taken over, or Redis could not be reached
+				// before the lease ran out. Stop the owner's work
+				l.cancel()
+				return
+			} else if err == nil {
+				renewedAt = time.Now()
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisLock(t *testing.T) {
+	r, done := testRedis(t)
+	defer done()
+	key := "warden:test:lock"
+
+	lock, err := acquireLock(r, key, time.Second)
+	assert.Nil(t, err)
+
+	_, err = acquireLock(r, key, time.Second)
+	assert.Equal(t, ErrLockHeld, errors.Cause(err))
+
+	// the heartbeat keeps the lock alive past its ttl
+	time.Sleep(1500 * time.Millisecond)
+	assert.Nil(t, lock.Check())
+	_, err = acquireLock(r, key, time.Second)
+	assert.Equal(t, ErrLockHeld, errors.Cause(err))
+
+	assert.Nil(t, lock.Release())
+	assert.NotNil(t, lock.Check())
+
+	next, err := acquireLock(r, key, time.Second)
+	assert.Nil(t, err)
+	assert.True(t, next.Token() > lock.Token())
+
+	// releasing a stale lock must not release the lock of the next owner
+	assert.Nil(t, lock.Release())
+	_, err = acquireLock(r, key, time.Second)
+	assert.Equal(t, ErrLockHeld, errors.Cause(err))
+	assert.Nil(t, next.Release())
+}
+
+func TestRedisLock_LostLease(t *testing.T) {
+	r, done := testRedis(t)
+	defer done()
+	key := "warden:test:lost-lock"
+
+	lock, err := acquireLock(r, key, time.Second)
+	assert.Nil(t, err)
+	defer lock.Release()
+
+	// another owner takes over the lock, i.e. after the lease expired
+	r.Set(key, lock.Token()+1, time.Minute)
+
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lock context was not cancelled after losing the lease")
+	}
+	assert.NotNil(t, lock.Check())
+}
+
+func TestRedisLock_Check(t *testing.T) {
+	r, done := testRedis(t)
+	defer done()
+	key := "warden:test:checked-lock"
+
+	// the heartbeat does not run before the end of the test
+	lock, err := acquireLock(r, key, time.Minute)
+	assert.Nil(t, err)
+	defer lock.Release()
+	assert.Nil(t, lock.Check())
+
+	// the takeover is found by comparing the token in Redis
+	r.Set(key, lock.Token()+1, time.Minute)
+	assert.NotNil(t, lock.Check())
+	assert.NotNil(t, lock.Context().Err())
+}
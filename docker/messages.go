@@ -1,30 +1,82 @@
 package docker
 
 import (
-	"bytes"
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"log"
 	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/pkg/errors"
+)
+
+// Streams of the Docker output reported in LogEntry
+const (
+	LogStreamBuild = "build"
+	LogStreamPush  = "push"
+	LogStreamPull  = "pull"
 )
 
-func streamResponse(body io.ReadCloser) {
-	content, _ := ioutil.ReadAll(body)
+// A single message from the Docker daemon's output when building, pushing or pulling
+// an image. Error and ErrorCode are set when the message reports a failure
+type LogEntry struct {
+	Stream    string // one of LogStreamBuild, LogStreamPush or LogStreamPull
+	Message   string
+	Error     string
+	ErrorCode int
+}
 
-	var message []string
-	for _, bline := range bytes.Split(content, []byte("\n")) {
-		bline = bytes.TrimSpace(bline)
-		if len(bline) == 0 {
-			message = append(message, "")
+// Reads the JSON message stream returned by the Docker daemon for builds, pushes
+// and pulls. Each message is passed to onLog as it arrives, or logged if onLog is nil.
+// Progress updates (i.e. layer upload progress bars) are skipped. The daemon reports
+// failures within the stream instead of through the HTTP status, so the first error
+// found in the stream is returned.
+func streamResponse(body io.Reader, stream string, onLog func(LogEntry)) error {
+	if onLog == nil {
+		onLog = func(entry LogEntry) {
+			if entry.Error != "" {
+				log.Println(entry.Error)
+			} else {
+				log.Println(entry.Message)
+			}
 		}
-		var msg map[string]string
-		json.Unmarshal(bline, &msg)
-		mm := ""
-		for _, m := range msg {
-			mm += m
+	}
+
+	var streamErr error
+	dec := json.NewDecoder(body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "error decoding docker response stream")
 		}
-		message = append(message, mm)
+
+		entry := LogEntry{Stream: stream}
+		switch {
+		case msg.Error != nil:
+			entry.Error = msg.Error.Message
+			entry.ErrorCode = msg.Error.Code
+		case msg.ErrorMessage != "":
+			entry.Error = msg.ErrorMessage
+		case msg.Progress != nil && msg.Progress.Total > 0:
+			continue
+		case msg.Stream != "":
+			entry.Message = strings.TrimRight(msg.Stream, "\n")
+		case msg.Status != "":
+			entry.Message = msg.Status
+			if msg.ID != "" {
+				entry.Message = msg.ID + ": " + msg.Status
+			}
+		default:
+			continue
+		}
+
+		if entry.Error != "" && streamErr == nil {
+			streamErr = errors.New(entry.Error)
+		}
+		onLog(entry)
 	}
-	log.Println(strings.Join(message, ""))
+
+	return streamErr
 }
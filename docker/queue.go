@@ -0,0 +1,136 @@
+package docker
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"warden/utils"
+)
+
+// A build waiting in the buildQueue
+type buildJob struct {
+	id      string
+	options ImageBuildOptions
+	done    func(hash string, err error)
+}
+
+// A FIFO queue of image builds served by a fixed pool of workers. A job is skipped
+// over while its project already has the maximum number of builds running, so one
+// busy project can't hold up the builds of the others.
+type buildQueue struct {
+	build      func(ImageBuildOptions) (string, error)
+	perProject int
+
+	m       sync.Mutex
+	cond    *sync.Cond
+	pending []*buildJob
+	running map[string]int // number of running builds per project
+	closed  bool
+}
+
+// Creates the queue and starts its workers. Values of workers and perProject below 1
+// are set to 1
+func newBuildQueue(build func(ImageBuildOptions) (string, error), workers, perProject int) *buildQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if perProject < 1 {
+		perProject = 1
+	}
+
+	q := &buildQueue{
+		build:      build,
+		perProject: perProject,
+		running:    make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.m)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Adds the build to the back of the queue. Returns an error if a build with the same
+// id is already waiting or if the queue is closed
+func (q *buildQueue) enqueue(job *buildJob) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.closed {
+		return errors.New("build queue is closed")
+	}
+	for _, j := range q.pending {
+		if j.id == job.id {
+			return errors.Errorf("build '%s' is already queued", job.id)
+		}
+	}
+	job.options.Name = utils.StrLowerTrim(job.options.Name)
+	q.pending = append(q.pending, job)
+	q.cond.Broadcast()
+	return nil
+}
+
+// Gets the position of the build in the queue, starting from 1 for the build that
+// is next in line. Returns 0 if the build is not waiting in the queue
+func (q *buildQueue) position(id string) int {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for i, j := range q.pending {
+		if j.id == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Stops the workers from taking new builds. Builds that are running are left to
+// complete while builds that are waiting are dropped
+func (q *buildQueue) close() {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	q.closed = true
+	q.pending = nil
+	q.cond.Broadcast()
+}
+
+// Takes the first build whose project is below its concurrency limit off the queue.
+// Must be called with the lock held. Returns nil if there is no such build
+func (q *buildQueue) next() *buildJob {
+	for i, j := range q.pending {
+		if q.running[j.options.Name] < q.perProject {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return j
+		}
+	}
+	return nil
+}
+
+func (q *buildQueue) work() {
+	for {
+		q.m.Lock()
+		job := q.next()
+		for job == nil && !q.closed {
+			q.cond.Wait()
+			job = q.next()
+		}
+		if job == nil {
+			q.m.Unlock()
+			return
+		}
+		q.running[job.options.Name]++
+		q.m.Unlock()
+
+		hash, err := q.build(job.options)
+		job.done(hash, err)
+
+		q.m.Lock()
+		if q.running[job.options.Name]--; q.running[job.options.Name] <= 0 {
+			delete(q.running, job.options.Name)
+		}
+		q.cond.Broadcast()
+		q.m.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildQueue(t *testing.T) {
+	release := make(chan struct{})
+	var m sync.Mutex
+	var order []string
+	q := newBuildQueue(func(options ImageBuildOptions) (string, error) {
+		<-release
+		m.Lock()
+		order = append(order, options.Hash)
+		m.Unlock()
+		return options.Hash, nil
+	}, 2, 1)
+	defer q.close()
+
+	var wg sync.WaitGroup
+	done := func(hash string, err error) {
+		assert.Nil(t, err)
+		wg.Done()
+	}
+
+	wg.Add(3)
+	assert.Nil(t, q.enqueue(&buildJob{id: "1", options: ImageBuildOptions{Name: "proj-a", Hash: "a1"}, done: done}))
+	assert.Nil(t, q.enqueue(&buildJob{id: "2", options: ImageBuildOptions{Name: "Proj-A", Hash: "a2"}, done: done}))
+	assert.Nil(t, q.enqueue(&buildJob{id: "3", options: ImageBuildOptions{Name: "proj-b", Hash: "b1"}, done: done}))
+
+	// proj-a is limited to 1 build at a time, so build 3 is taken before build 2
+	for i := 0; i < 100 && q.position("3") != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, q.position("3"))
+	assert.Equal(t, 1, q.position("2"))
+	assert.Equal(t, 0, q.position("1"))
+	assert.EqualError(t, q.enqueue(&buildJob{id: "2"}), "build '2' is already queued")
+
+	close(release)
+	wg.Wait()
+	assert.Len(t, order, 3)
+	assert.NotEqual(t, "a2", order[0]) // a2 only starts after a1 is done
+
+	q.close()
+	assert.EqualError(t, q.enqueue(&buildJob{id: "4"}), "build queue is closed")
+}
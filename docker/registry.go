@@ -1,9 +1,12 @@
 package docker
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strings"
 
+	"github.com/docker/docker/api/types"
 	"github.com/heroku/docker-registry-client/registry"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -11,34 +14,56 @@ import (
 	"warden/utils"
 )
 
-// Check if image (project name) by user (username) with tag exists in
-// the private repository. The hash must be
-func (c *Client) hubHasImage(name, hash string) (bool, error) {
+// Finds the tag of the image (project name) in the private repository whose commit
+// hash starts with the hash given. The hash must be at least 8 characters long. If no
+// such image exists, an empty string is returned
+func (c *Client) hubFindTag(name, hash string) (string, error) {
 	if len(hash) < 8 {
-		return false, nil
+		return "", nil
 	}
 
 	repos, err := c.hub.Repositories()
 
 	if err != nil {
-		return false, errors.Wrap(err, "error getting repos from private registry")
+		return "", errors.Wrap(err, "error getting repos from private registry")
 	}
 	if !utils.StrIsIn(name, repos) {
 		// repos doesn't even exist. Image does not exist!
-		return false, nil
+		return "", nil
 	}
 
 	tags, err := c.hub.Tags(name)
 	if err != nil {
-		return false, errors.Wrapf(err, "error getting tags from private registry (%s) for repo (%s)", c.hub.URL, name)
+		return "", errors.Wrapf(err, "error getting tags from private registry (%s) for repo (%s)", c.hub.URL, name)
 	}
 	hash = utils.StrLowerTrim(hash)
 	for _, t := range tags {
 		if strings.HasPrefix(utils.StrLowerTrim(t), hash) {
-			return true, nil
+			return utils.StrLowerTrim(t), nil
 		}
 	}
-	return false, nil
+	return "", nil
+}
+
+// Gets the digest of the image (project name) tagged with the full commit hash
+// from the private registry
+func (c *Client) ImageDigest(name, hash string) (string, error) {
+	digest, err := c.hub.ManifestDigest(utils.StrLowerTrim(name), utils.StrLowerTrim(hash))
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting digest of image '%s:%s' from private registry", name, hash)
+	}
+	return digest.String(), nil
+}
+
+// Forms the base64 encoded credentials used by the Docker daemon to push images
+// to the private registry
+func registryAuth() string {
+	auth, _ := json.Marshal(types.AuthConfig{
+		Username:      viper.GetString("registry.username"),
+		Password:      viper.GetString("registry.password"),
+		ServerAddress: viper.GetString("registry.domain"),
+	})
+	return base64.URLEncoding.EncodeToString(auth)
 }
 
 // Creates a new registry hub
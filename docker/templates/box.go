@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/pkg/errors"
@@ -14,7 +16,28 @@ type Box struct {
 	templates map[string]*template.Template
 }
 
+// Other names the runtime environments are known by, mapped to their template
+var aliases = map[string]string{
+	"python3": "python",
+}
+
+var (
+	once     sync.Once
+	box      *Box
+	boxError error
+)
+
+// Returns the Box holding the Dockerfile templates. Each template is named after the
+// runtime environment it builds, i.e. python.dtpl builds the "python" runtime. The box
+// is a singleton, templates are only read from disk on the first call
 func NewBox() (*Box, error) {
+	once.Do(func() {
+		box, boxError = loadBox()
+	})
+	return box, boxError
+}
+
+func loadBox() (*Box, error) {
 	_, dir, _, _ := runtime.Caller(0)
 	dir = filepath.Dir(dir)
 
@@ -48,9 +71,34 @@ func NewBox() (*Box, error) {
 }
 
 func (b *Box) GetTemplate(name string) (*template.Template, error) {
-	tpl, ok := b.templates[name]
+	tpl, ok := b.templates[b.Resolve(name)]
 	if !ok {
 		return nil, errors.Errorf("No template with key: %s", name)
 	}
 	return tpl, nil
 }
+
+// Checks if a template is registered under the name or one of its aliases
+func (b *Box) HasTemplate(name string) bool {
+	_, ok := b.templates[b.Resolve(name)]
+	return ok
+}
+
+// Gets the name of the template that the alias stands for, i.e. "python" for
+// "python3". Names that aren't aliases are returned as is
+func (b *Box) Resolve(name string) string {
+	if n, ok := aliases[name]; ok {
+		return n
+	}
+	return name
+}
+
+// Lists the names of all registered templates in alphabetical order
+func (b *Box) Names() []string {
+	var names []string
+	for name := range b.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
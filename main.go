@@ -17,6 +17,7 @@ import (
 	"warden/application"
 	"warden/config"
 	"warden/store"
+	"warden/store/model"
 )
 
 func init() {
@@ -62,6 +63,8 @@ func localSetup() (CleanUp func()) {
 		"https://github.com/kantopark-tpl/python-simple",
 		projectName,
 		"A sample python project",
+		model.RuntimeSettings{Runtime: "python", Handler: "main.handler"},
+		model.Resources{},
 		*user)
 	if err != nil {
 		log.Fatalln(err)
@@ -69,7 +72,7 @@ func localSetup() (CleanUp func()) {
 
 	// Create an Instance
 	hash := "95bfc3515452bfafeb2e04f948ac26d1e2a871c8"
-	inst, err := db.InstanceCreate(hash, "dev", proj.Name)
+	inst, err := db.InstanceCreate(model.Instance{CommitHash: hash, Alias: "dev"}, proj.Name)
 	if err != nil {
 		log.Fatalln(err)
 	}
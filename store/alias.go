@@ -0,0 +1,75 @@
+package store
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"warden/store/model"
+	"warden/utils"
+)
+
+// Records that the instance's alias now points to the instance's commit. The username
+// is the user who made the change. rollbackOf is the id of the assignment restored,
+// or 0 if the change is not a rollback
+func (s *Store) AliasAssign(inst model.Instance, username string, rollbackOf uint) (*model.AliasAssignment, error) {
+	assignment := &model.AliasAssignment{
+		ProjectID:  inst.ProjectID,
+		Alias:      inst.Alias,
+		InstanceID: inst.ID,
+		CommitHash: inst.CommitHash,
+		AssignedBy: username,
+		RollbackOf: rollbackOf,
+	}
+	if err := assignment.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(assignment).Error; err != nil {
+		return nil, errors.Wrapf(err, "error recording assignment of alias '%s'", assignment.Alias)
+	}
+	return assignment, nil
+}
+
+// Lists the commits the alias of the project was pointed to, most recent first
+func (s *Store) AliasHistory(projectID uint, alias string) (history []model.AliasAssignment, err error) {
+	alias = aliasName(alias)
+	if err := s.db.Where("project_id = ? AND alias = ?", projectID, alias).Order("id DESC").Find(&history).Error; err != nil {
+		return nil, errors.Wrapf(err, "error getting history of alias '%s'", alias)
+	}
+	return history, nil
+}
+
+// Gets the assignment a rollback of the alias restores. That is the assignment with
+// the id if it is not 0, otherwise the most recent one of a commit other than the
+// alias' current commit. Returns gorm.ErrRecordNotFound if there is none
+func (s *Store) AliasRollbackTarget(projectID uint, alias, currentCommit string, id uint) (*model.AliasAssignment, error) {
+	history, err := s.AliasHistory(projectID, alias)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range history {
+		if (id != 0 && a.ID == id) || (id == 0 && a.CommitHash != currentCommit) {
+			return &a, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// Replaces the commit hash the instance's assignments were recorded with by the full
+// hash it resolved to, so that the history refers to the commit that was deployed
+func (s *Store) AliasResolveCommit(instanceID uint, commitHash, resolved string) error {
+	if err := s.db.Model(&model.AliasAssignment{}).
+		Where("instance_id = ? AND commit_hash = ?", instanceID, commitHash).
+		Update("commit_hash", resolved).Error; err != nil {
+		return errors.Wrapf(err, "error updating alias history of instance '%d'", instanceID)
+	}
+	return nil
+}
+
+// Gets the name the alias is stored under
+func aliasName(alias string) string {
+	alias = utils.StrLowerTrim(alias)
+	if alias == "" {
+		return "latest"
+	}
+	return alias
+}
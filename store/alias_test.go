@@ -0,0 +1,54 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
+)
+
+func TestAliasHistory(t *testing.T) {
+	proj, err := S.ProjectGetById(1)
+	assert.Nil(t, err)
+
+	inst, err := S.InstanceCreate(model.Instance{CommitHash: "1111111", Alias: "history"}, proj.Name)
+	assert.Nil(t, err)
+	first, err := S.AliasAssign(*inst, username, 0)
+	assert.Nil(t, err)
+
+	// nothing to roll back to while the alias only ever had one commit
+	_, err = S.AliasRollbackTarget(proj.ID, "history", inst.CommitHash, 0)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+
+	inst.CommitHash = "2222222"
+	inst, err = S.InstanceUpdate(inst)
+	assert.Nil(t, err)
+	_, err = S.AliasAssign(*inst, "someone-else", 0)
+	assert.Nil(t, err)
+
+	// short hashes are replaced once the build resolves them
+	assert.Nil(t, S.AliasResolveCommit(inst.ID, "2222222", "2222222abcdef"))
+
+	history, err := S.AliasHistory(proj.ID, " History ")
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "2222222abcdef", history[0].CommitHash)
+	assert.Equal(t, "someone-else", history[0].AssignedBy)
+	assert.Equal(t, "1111111", history[1].CommitHash)
+	assert.Equal(t, username, history[1].AssignedBy)
+
+	target, err := S.AliasRollbackTarget(proj.ID, "history", "2222222abcdef", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, target.ID)
+
+	target, err = S.AliasRollbackTarget(proj.ID, "history", "2222222abcdef", history[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, history[0].ID, target.ID)
+
+	_, err = S.AliasRollbackTarget(proj.ID, "history", "2222222abcdef", 9999)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+
+	assert.Nil(t, S.InstanceDelete(inst.ProjectID, inst.CommitHash))
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"warden/store/model"
+)
+
+const _EVENTS = "Events"
+
+// Creates a queued deployment for the instance
+func (s *Store) DeploymentCreate(inst model.Instance) (*model.Deployment, error) {
+	deployment := &model.Deployment{
+		InstanceID: inst.ID,
+		Alias:      inst.Alias,
+		CommitHash: inst.CommitHash,
+		State:      model.DeploymentQueued,
+		Events:     []model.DeploymentEvent{{State: model.DeploymentQueued}},
+	}
+	if err := deployment.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(deployment).Error; err != nil {
+		return nil, errors.Wrap(err, "error creating deployment")
+	}
+	return deployment, nil
+}
+
+// Gets the deployment by its ID along with all its events
+func (s *Store) DeploymentGetById(id uint) (*model.Deployment, error) {
+	var deployment model.Deployment
+	if err := s.db.Preload(_EVENTS).First(&deployment, id).Error; err == gorm.ErrRecordNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting deployment with id '%d'", id)
+	}
+	return &deployment, nil
+}
+
+// Gets the most recent deployment of the instance along with all its events
+func (s *Store) DeploymentGetLatest(instanceID uint) (*model.Deployment, error) {
+	var deployment model.Deployment
+	if err := s.db.Preload(_EVENTS).Order("id desc").First(&deployment, "instance_id = ?", instanceID).Error; err == gorm.ErrRecordNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting latest deployment of instance with id '%d'", instanceID)
+	}
+	return &deployment, nil
+}
+
+// Lists the deployments of the instance that are in the state given, oldest first
+func (s *Store) DeploymentListByState(instanceID uint, state string) (deployments []model.Deployment, err error) {
+	if err := s.db.Order("id").Find(&deployments, "instance_id = ? AND state = ?", instanceID, state).Error; err != nil {
+		return nil, errors.Wrapf(err, "error listing deployments of instance with id '%d'", instanceID)
+	}
+	return
+}
+
+// Lists the deployments of all instances that are in any of the states given, oldest first
+func (s *Store) DeploymentListInStates(states ...string) (deployments []model.Deployment, err error) {
+	if err := s.db.Order("id").Find(&deployments, "state IN (?)", states).Error; err != nil {
+		return nil, errors.Wrap(err, "error listing deployments")
+	}
+	return
+}
+
+// Moves the deployment to the new state and records the change as an event. The
+// message is usually the reason for the change. If the deployment fails, the message
+// is kept as the deployment's error. Returns an error if the change is not allowed
+func (s *Store) DeploymentTransition(id uint, state, message string) (*model.Deployment, error) {
+	deployment, err := s.DeploymentGetById(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := deployment.CanTransition(state); err != nil {
+		return nil, err
+	}
+
+	deployment.State = state
+	if state == model.DeploymentFailed {
+		deployment.Error = message
+	}
+	if deployment.IsFinished() {
+		now := time.Now()
+		deployment.FinishedAt = &now
+	}
+	deployment.Events = append(deployment.Events, model.DeploymentEvent{
+		DeploymentID: deployment.ID,
+		State:        state,
+		Message:      message,
+	})
+
+	if err := s.db.Save(deployment).Error; err != nil {
+		return nil, errors.Wrapf(err, "could not move deployment '%d' to state '%s'", id, state)
+	}
+	return deployment, nil
+}
+
+// Records the commit hash and the digest of the image that the deployment runs
+func (s *Store) DeploymentSetImage(id uint, commitHash, digest string) error {
+	if err := s.db.Model(&model.Deployment{ID: id}).Updates(map[string]interface{}{
+		"commit_hash":  commitHash,
+		"image_digest": digest,
+	}).Error; err != nil {
+		return errors.Wrapf(err, "could not set image of deployment with id '%d'", id)
+	}
+	return nil
+}
+
+// Removes all deployments of the instance and their events
+func (s *Store) DeploymentDeleteByInstance(instanceID uint) error {
+	var ids []uint
+	if err := s.db.Model(&model.Deployment{}).Where("instance_id = ?", instanceID).Pluck("id", &ids).Error; err != nil {
+		return errors.Wrapf(err, "error listing deployments of instance with id '%d'", instanceID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := s.db.Where("deployment_id IN (?)", ids).Delete(&model.DeploymentEvent{}).Error; err != nil {
+		return errors.Wrapf(err, "error removing deployment events of instance with id '%d'", instanceID)
+	}
+	if err := s.db.Where("deployment_id IN (?)", ids).Delete(&model.DeploymentLog{}).Error; err != nil {
+		return errors.Wrapf(err, "error removing deployment logs of instance with id '%d'", instanceID)
+	}
+	if err := s.db.Where("id IN (?)", ids).Delete(&model.Deployment{}).Error; err != nil {
+		return errors.Wrapf(err, "error removing deployments of instance with id '%d'", instanceID)
+	}
+	return nil
+}
+
+// Appends a line to the build logs of the deployment
+func (s *Store) DeploymentLogAppend(entry *model.DeploymentLog) error {
+	if entry.DeploymentID == 0 {
+		return errors.New("deployment log must be linked to a deployment via a deployment id key")
+	}
+	if err := s.db.Create(entry).Error; err != nil {
+		return errors.Wrapf(err, "error saving log of deployment with id '%d'", entry.DeploymentID)
+	}
+	return nil
+}
+
+// Lists the build logs of the deployment in the order they were written. Only lines
+// after the line with the afterID are returned, so that a reader can pick up from
+// where it left off. Use 0 to list all lines
+func (s *Store) DeploymentLogList(deploymentID, afterID uint) (logs []model.DeploymentLog, err error) {
+	if err := s.db.Order("id").Find(&logs, "deployment_id = ? AND id > ?", deploymentID, afterID).Error; err != nil {
+		return nil, errors.Wrapf(err, "error listing logs of deployment with id '%d'", deploymentID)
+	}
+	return
+}
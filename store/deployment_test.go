@@ -0,0 +1,66 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
+)
+
+func TestDeployment(t *testing.T) {
+	inst, err := S.InstanceGetByHash(1, "95bfc3515452bfafeb2e04f948ac26d1e2a871c8")
+	assert.Nil(t, err)
+
+	d, err := S.DeploymentCreate(*inst)
+	assert.Nil(t, err)
+	assert.Equal(t, d.State, model.DeploymentQueued)
+
+	_, err = S.DeploymentTransition(d.ID, model.DeploymentRunning, "")
+	assert.EqualError(t, err, "deployment cannot move from 'queued' to 'running'")
+
+	_, err = S.DeploymentTransition(d.ID, model.DeploymentBuilding, "")
+	assert.Nil(t, err)
+	err = S.DeploymentSetImage(d.ID, inst.CommitHash, "sha256:abc")
+	assert.Nil(t, err)
+	d, err = S.DeploymentTransition(d.ID, model.DeploymentFailed, "build failed")
+	assert.Nil(t, err)
+	assert.NotNil(t, d.FinishedAt)
+
+	latest, err := S.DeploymentGetLatest(inst.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, latest.ID, d.ID)
+	assert.Equal(t, latest.State, model.DeploymentFailed)
+	assert.Equal(t, latest.Error, "build failed")
+	assert.Equal(t, latest.ImageDigest, "sha256:abc")
+	assert.Len(t, latest.Events, 3)
+
+	deployments, err := S.DeploymentListByState(inst.ID, model.DeploymentFailed)
+	assert.Nil(t, err)
+	assert.Len(t, deployments, 1)
+
+	deployments, err = S.DeploymentListInStates(model.DeploymentQueued, model.DeploymentFailed)
+	assert.Nil(t, err)
+	assert.Len(t, deployments, 1)
+
+	err = S.DeploymentLogAppend(&model.DeploymentLog{DeploymentID: d.ID, Stream: "build", Message: "Step 1/5"})
+	assert.Nil(t, err)
+	err = S.DeploymentLogAppend(&model.DeploymentLog{DeploymentID: d.ID, Stream: "build", Error: "no such file", ErrorCode: 1})
+	assert.Nil(t, err)
+	err = S.DeploymentLogAppend(&model.DeploymentLog{Stream: "build"})
+	assert.NotNil(t, err)
+
+	logs, err := S.DeploymentLogList(d.ID, 0)
+	assert.Nil(t, err)
+	assert.Len(t, logs, 2)
+	logs, err = S.DeploymentLogList(d.ID, logs[0].ID)
+	assert.Nil(t, err)
+	assert.Len(t, logs, 1)
+	assert.Equal(t, logs[0].Error, "no such file")
+
+	err = S.DeploymentDeleteByInstance(inst.ID)
+	assert.Nil(t, err)
+	_, err = S.DeploymentGetLatest(inst.ID)
+	assert.EqualError(t, err, gorm.ErrRecordNotFound.Error())
+}
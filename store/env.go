@@ -0,0 +1,100 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+
+	"warden/store/model"
+)
+
+// Sets the environment variable of the project. An empty alias sets the variable for
+// every alias of the project. The value of secrets is encrypted before it is stored
+func (s *Store) EnvVarSet(projectName, alias, name, value string, secret bool) (*model.EnvVar, error) {
+	project, err := s.ProjectGetByName(projectName)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &model.EnvVar{ProjectID: project.ID, Alias: alias, Name: name}
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+	// an empty alias is a zero value, so the conditions can't be given as a struct
+	if err := s.db.Where("project_id = ? AND alias = ? AND name = ?", env.ProjectID, env.Alias, env.Name).First(env).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.Wrapf(err, "error getting environment variable '%s'", name)
+	}
+
+	env.Secret = secret
+	env.Value = value
+	if secret {
+		if env.Value, err = s.encrypt(value); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.db.Save(env).Error; err != nil {
+		return nil, errors.Wrapf(err, "error saving environment variable '%s'", name)
+	}
+	return env, nil
+}
+
+// Removes the environment variable of the project. An empty alias removes the variable
+// set for every alias of the project
+func (s *Store) EnvVarDelete(projectName, alias, name string) error {
+	project, err := s.ProjectGetByName(projectName)
+	if err != nil {
+		return err
+	}
+
+	env := &model.EnvVar{ProjectID: project.ID, Alias: alias, Name: name}
+	if err := env.Validate(); err != nil {
+		return err
+	}
+	if err := s.db.Where("project_id = ? AND alias = ? AND name = ?", env.ProjectID, env.Alias, env.Name).First(env).Error; err == gorm.ErrRecordNotFound {
+		return err
+	} else if err != nil {
+		return errors.Wrapf(err, "error getting environment variable '%s'", name)
+	}
+	if err := s.db.Delete(env).Error; err != nil {
+		return errors.Wrapf(err, "error removing environment variable '%s'", name)
+	}
+	return nil
+}
+
+// Gets the environment variables passed to the instances of the project's alias with
+// the secrets decrypted, along with the sorted names of the secrets. Variables of the
+// alias take precedence over the ones set for every alias
+func (s *Store) EnvVarResolve(projectID uint, alias string) (map[string]string, []string, error) {
+	var vars []model.EnvVar
+	if err := s.db.Where("project_id = ?", projectID).Order("alias").Find(&vars).Error; err != nil {
+		return nil, nil, errors.Wrapf(err, "error listing environment variables of project with id '%d'", projectID)
+	}
+
+	env := make(map[string]string)
+	secret := make(map[string]bool)
+	for _, v := range vars {
+		if !v.AppliesTo(alias) {
+			continue
+		}
+		// ordered by alias, so the alias' variables come after the project's
+		value := v.Value
+		if v.Secret {
+			var err error
+			if value, err = s.decrypt(v.Value); err != nil {
+				return nil, nil, errors.Wrapf(err, "error reading secret '%s'", v.Name)
+			}
+		}
+		env[v.Name] = value
+		secret[v.Name] = v.Secret
+	}
+
+	var secrets []string
+	for name, ok := range secret {
+		if ok {
+			secrets = append(secrets, name)
+		}
+	}
+	sort.Strings(secrets)
+	return env, secrets, nil
+}
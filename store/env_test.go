@@ -0,0 +1,74 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvVar(t *testing.T) {
+	proj, err := S.ProjectGetById(1)
+	assert.Nil(t, err)
+
+	_, err = S.EnvVarSet(proj.Name, "", "LOG_LEVEL", "info", false)
+	assert.Nil(t, err)
+	_, err = S.EnvVarSet(proj.Name, "Dev", "LOG_LEVEL", "debug", false)
+	assert.Nil(t, err)
+	secret, err := S.EnvVarSet(proj.Name, "", "API_TOKEN", "s3cr3t", true)
+	assert.Nil(t, err)
+	assert.NotContains(t, secret.Value, "s3cr3t")
+
+	_, err = S.EnvVarSet(proj.Name, "", "1BAD", "value", false)
+	assert.EqualError(t, err, "Environment variable '1BAD' is not a valid name")
+
+	env, secrets, err := S.EnvVarResolve(proj.ID, "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "debug", "API_TOKEN": "s3cr3t"}, env)
+	assert.Equal(t, []string{"API_TOKEN"}, secrets)
+
+	env, _, err = S.EnvVarResolve(proj.ID, "latest")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info", "API_TOKEN": "s3cr3t"}, env)
+
+	// setting a variable again replaces its value
+	_, err = S.EnvVarSet(proj.Name, "", "LOG_LEVEL", "warn", false)
+	assert.Nil(t, err)
+
+	// secrets are never encoded in plaintext
+	proj, err = S.ProjectGetById(1)
+	assert.Nil(t, err)
+	assert.Len(t, proj.Env, 3)
+	data, err := json.Marshal(proj)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "s3cr3t")
+	assert.Contains(t, string(data), "warn")
+
+	assert.Nil(t, S.EnvVarDelete(proj.Name, "dev", "LOG_LEVEL"))
+	assert.NotNil(t, S.EnvVarDelete(proj.Name, "dev", "LOG_LEVEL"))
+	env, _, err = S.EnvVarResolve(proj.ID, "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, "warn", env["LOG_LEVEL"])
+
+	assert.Nil(t, S.EnvVarDelete(proj.Name, "", "LOG_LEVEL"))
+	assert.Nil(t, S.EnvVarDelete(proj.Name, "", "API_TOKEN"))
+}
+
+func TestSecret(t *testing.T) {
+	s := &Store{secretKey: secretKey("key")}
+	sealed, err := s.encrypt("value")
+	assert.Nil(t, err)
+	other, err := s.encrypt("value")
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealed, other)
+
+	plain, err := s.decrypt(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", plain)
+
+	_, err = (&Store{secretKey: secretKey("other")}).decrypt(sealed)
+	assert.NotNil(t, err)
+
+	_, err = (&Store{secretKey: secretKey("  ")}).encrypt("value")
+	assert.EqualError(t, err, "store.secret_key must be set to store secrets")
+}
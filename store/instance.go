@@ -7,17 +7,16 @@ import (
 	"warden/store/model"
 )
 
-// Creates a runnable instance for the project
-func (s *Store) InstanceCreate(commit, alias string, projectName string) (*model.Instance, error) {
+// Creates a runnable instance for the project from the instance's settings. Runtime
+// settings and resource limits that are left empty are inherited from the project
+func (s *Store) InstanceCreate(inst model.Instance, projectName string) (*model.Instance, error) {
 	project, err := s.ProjectGetByName(projectName)
 	if err != nil {
 		return nil, err
 	}
-	instance := &model.Instance{
-		Alias:      alias,
-		CommitHash: commit,
-		ProjectID:  project.ID,
-	}
+	instance := &inst
+	instance.ID = 0
+	instance.ProjectID = project.ID
 
 	if err = instance.Validate(); err != nil {
 		return nil, err
@@ -51,12 +50,15 @@ func (s *Store) InstanceGetById(id uint) (*model.Instance, error) {
 	return &inst, nil
 }
 
-// Deletes a running instance of the project
+// Deletes a running instance of the project along with its deployment records
 func (s *Store) InstanceDelete(projectID uint, commitHash string) error {
 	project, err := s.InstanceGetByHash(projectID, commitHash)
 	if err != nil {
 		return err
 	}
+	if err := s.DeploymentDeleteByInstance(project.ID); err != nil {
+		return err
+	}
 	if err := s.db.Delete(project).Error; err != nil {
 		return errors.Wrapf(err, "error removing instance with project '%d' and commit hash '%s'", projectID, commitHash)
 	}
@@ -76,6 +78,11 @@ func (s *Store) InstanceUpdate(newInstance *model.Instance) (*model.Instance, er
 	}
 	inst.CommitHash = newInstance.CommitHash
 	inst.Alias = newInstance.Alias
+	inst.RuntimeSettings = newInstance.RuntimeSettings
+	inst.Resources = newInstance.Resources
+	inst.Replicas = newInstance.Replicas
+	inst.TrafficSplit = newInstance.TrafficSplit
+	inst.MirrorAlias = newInstance.MirrorAlias
 
 	if err := s.db.Save(inst).Error; err != nil {
 		return nil, errors.Wrapf(err, "could not update instance: %+v", inst)
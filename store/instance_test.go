@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
 )
 
 func TestInstance(t *testing.T) {
@@ -13,8 +15,22 @@ func TestInstance(t *testing.T) {
 	proj, err := S.ProjectGetById(inst.ProjectID)
 	assert.Nil(t, err)
 
-	inst, err = S.InstanceCreate("0c0aafa7ec1250be737d0d39f6de36854baa0f8b", "", proj.Name)
+	inst, err = S.InstanceCreate(model.Instance{
+		CommitHash:      "0c0aafa7ec1250be737d0d39f6de36854baa0f8b",
+		RuntimeSettings: model.RuntimeSettings{Handler: "other.handler"},
+		Resources:       model.Resources{Memory: 1 << 28},
+		Replicas:        model.Replicas{MinReplica: 0, MaxReplica: 3},
+		MirrorAlias:     "shadow",
+	}, proj.Name)
+	assert.Nil(t, err)
+	stored, err := S.InstanceGetById(inst.ID)
 	assert.Nil(t, err)
+	assert.Equal(t, "shadow", stored.MirrorAlias)
+	assert.Equal(t, 3, stored.MaxReplica)
+	assert.Equal(t, proj.RuntimeSettings.Merge(inst.RuntimeSettings).Handler, "other.handler")
+	assert.Equal(t, proj.RuntimeSettings.Merge(inst.RuntimeSettings).Runtime, "python")
+	assert.Equal(t, proj.Resources.Merge(inst.Resources).Memory, int64(1<<28))
+	assert.Equal(t, inst.MaxReplica, 3)
 
 	inst.Alias = "test-2"
 	inst, err = S.InstanceUpdate(inst)
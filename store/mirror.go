@@ -0,0 +1,29 @@
+package store
+
+import (
+	"github.com/pkg/errors"
+
+	"warden/store/model"
+)
+
+// Records the result of a request mirrored from the alias to its shadow alias
+func (s *Store) MirrorResultAppend(result *model.MirrorResult) error {
+	if result.ProjectID == 0 {
+		return errors.New("mirror result must be linked to a project via a project id key")
+	}
+	result.Alias = aliasName(result.Alias)
+	if err := s.db.Create(result).Error; err != nil {
+		return errors.Wrapf(err, "error recording mirror result of alias '%s'", result.Alias)
+	}
+	return nil
+}
+
+// Lists the results of the requests mirrored from the alias of the project, most
+// recent first. At most limit results are listed
+func (s *Store) MirrorResultList(projectID uint, alias string, limit int) (results []model.MirrorResult, err error) {
+	alias = aliasName(alias)
+	if err := s.db.Where("project_id = ? AND alias = ?", projectID, alias).Order("id DESC").Limit(limit).Find(&results).Error; err != nil {
+		return nil, errors.Wrapf(err, "error listing mirror results of alias '%s'", alias)
+	}
+	return results, nil
+}
@@ -0,0 +1,29 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
+)
+
+func TestMirrorResult(t *testing.T) {
+	proj, err := S.ProjectGetById(1)
+	assert.Nil(t, err)
+
+	for _, status := range []int{200, 500} {
+		err = S.MirrorResultAppend(&model.MirrorResult{ProjectID: proj.ID, MirrorAlias: "shadow", Status: 200, MirrorStatus: status})
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, S.MirrorResultAppend(&model.MirrorResult{}))
+
+	results, err := S.MirrorResultList(proj.ID, "Latest", 10)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, 500, results[0].MirrorStatus)
+
+	results, err = S.MirrorResultList(proj.ID, "", 1)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+}
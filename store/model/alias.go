@@ -0,0 +1,37 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"warden/utils"
+)
+
+// An AliasAssignment records the commit an alias of the project was pointed to, who
+// pointed it there and when. The assignments of an alias form its history, which is
+// what a rollback restores from
+type AliasAssignment struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	ProjectID  uint      `json:"project_id" gorm:"index:idx_alias_assignment"`
+	Alias      string    `json:"alias" gorm:"type:varchar(100);index:idx_alias_assignment"`
+	InstanceID uint      `json:"instance_id"`
+	CommitHash string    `json:"commit_hash" gorm:"type:varchar(100)"`
+	AssignedBy string    `json:"assigned_by" gorm:"type:varchar(100)"` // username of the user who made the change
+	RollbackOf uint      `json:"rollback_of,omitempty"`                // assignment restored by a rollback, if any
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (a *AliasAssignment) Validate() error {
+	if a.ProjectID == 0 {
+		return errors.New("alias assignment must be linked to a project via a project id key")
+	}
+	a.Alias = utils.StrLowerTrim(a.Alias)
+	if a.Alias == "" {
+		a.Alias = "latest"
+	}
+	if a.CommitHash == "" {
+		return errors.New("alias assignment must have a commit hash")
+	}
+	return nil
+}
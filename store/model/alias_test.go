@@ -0,0 +1,23 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAliasAssignment(t *testing.T) {
+	a := &AliasAssignment{CommitHash: "95bfc35"}
+	assert.EqualError(t, a.Validate(), "alias assignment must be linked to a project via a project id key")
+
+	a.ProjectID = 1
+	assert.Nil(t, a.Validate())
+	assert.Equal(t, "latest", a.Alias)
+
+	a.Alias = " Dev "
+	assert.Nil(t, a.Validate())
+	assert.Equal(t, "dev", a.Alias)
+
+	a.CommitHash = ""
+	assert.EqualError(t, a.Validate(), "alias assignment must have a commit hash")
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"warden/utils"
+)
+
+// States of a deployment. A deployment starts off queued and moves through the
+// build and deploy stages until it is running. Failed and stopped are final states
+const (
+	DeploymentQueued    = "queued"
+	DeploymentBuilding  = "building"
+	DeploymentPushing   = "pushing"
+	DeploymentDeploying = "deploying"
+	DeploymentRunning   = "running"
+	DeploymentFailed    = "failed"
+	DeploymentStopped   = "stopped"
+)
+
+// The states a deployment is allowed to move to from each state. Queued skips the
+// build and building can skip pushing when the image already exists in the registry.
+// Builds interrupted by a restart move back to queued
+var deploymentTransitions = map[string][]string{
+	DeploymentQueued:    {DeploymentBuilding, DeploymentDeploying, DeploymentFailed, DeploymentStopped},
+	DeploymentBuilding:  {DeploymentQueued, DeploymentPushing, DeploymentDeploying, DeploymentFailed, DeploymentStopped},
+	DeploymentPushing:   {DeploymentQueued, DeploymentDeploying, DeploymentFailed, DeploymentStopped},
+	DeploymentDeploying: {DeploymentRunning, DeploymentFailed, DeploymentStopped},
+	DeploymentRunning:   {DeploymentFailed, DeploymentStopped},
+	DeploymentFailed:    {},
+	DeploymentStopped:   {},
+}
+
+// A Deployment records a single attempt at building and deploying an Instance's
+// commit. Every change in state is kept as a DeploymentEvent so that it is possible
+// to tell how far the deployment got and why it failed.
+type Deployment struct {
+	ID          uint              `json:"id" gorm:"primary_key"`
+	InstanceID  uint              `json:"instance_id" gorm:"index"`
+	Alias       string            `json:"alias" gorm:"type:varchar(100)"`
+	CommitHash  string            `json:"commit_hash" gorm:"type:varchar(100)"`
+	State       string            `json:"state" gorm:"type:varchar(20)"`
+	Error       string            `json:"error" gorm:"type:varchar(2048)"`       // reason the deployment failed, if it did
+	ImageDigest string            `json:"image_digest" gorm:"type:varchar(100)"` // digest of the image in the registry
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	FinishedAt  *time.Time        `json:"finished_at"` // time the deployment reached a final state
+	Events      []DeploymentEvent `json:"events" gorm:"foreignkey:DeploymentID"`
+}
+
+// A change in the state of a Deployment
+type DeploymentEvent struct {
+	ID           uint      `json:"-" gorm:"primary_key"`
+	DeploymentID uint      `json:"-" gorm:"index"`
+	State        string    `json:"state" gorm:"type:varchar(20)"`
+	Message      string    `json:"message" gorm:"type:varchar(2048)"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// A line of the image build or push output of a Deployment. Error is set when the
+// line reports a failure
+type DeploymentLog struct {
+	ID           uint      `json:"id" gorm:"primary_key"`
+	DeploymentID uint      `json:"-" gorm:"index"`
+	Stream       string    `json:"stream" gorm:"type:varchar(20)"` // build or push
+	Message      string    `json:"message" gorm:"type:text"`
+	Error        string    `json:"error,omitempty" gorm:"type:text"`
+	ErrorCode    int       `json:"error_code,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (d *Deployment) Validate() error {
+	if d.InstanceID == 0 {
+		return errors.New("deployment must be linked to an instance via an instance id key")
+	}
+	if d.State == "" {
+		d.State = DeploymentQueued
+	}
+	if _, ok := deploymentTransitions[d.State]; !ok {
+		return errors.Errorf("Unknown deployment state: '%s'", d.State)
+	}
+	return nil
+}
+
+// Checks if the deployment is allowed to move to the state
+func (d *Deployment) CanTransition(state string) error {
+	if _, ok := deploymentTransitions[state]; !ok {
+		return errors.Errorf("Unknown deployment state: '%s'", state)
+	}
+	if !utils.StrIsIn(state, deploymentTransitions[d.State]) {
+		return errors.Errorf("deployment cannot move from '%s' to '%s'", d.State, state)
+	}
+	return nil
+}
+
+// Reports whether the deployment has reached a final state
+func (d *Deployment) IsFinished() bool {
+	return len(deploymentTransitions[d.State]) == 0
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployment(t *testing.T) {
+	d := &Deployment{}
+	err := d.Validate()
+	assert.EqualError(t, err, "deployment must be linked to an instance via an instance id key")
+
+	d.InstanceID = 1
+	err = d.Validate()
+	assert.Nil(t, err)
+	assert.Equal(t, d.State, DeploymentQueued)
+	assert.False(t, d.IsFinished())
+
+	assert.Nil(t, d.CanTransition(DeploymentBuilding))
+	assert.Nil(t, d.CanTransition(DeploymentDeploying))
+	assert.EqualError(t, d.CanTransition(DeploymentRunning), "deployment cannot move from 'queued' to 'running'")
+	assert.EqualError(t, d.CanTransition("bad_state"), "Unknown deployment state: 'bad_state'")
+
+	d.State = DeploymentFailed
+	assert.True(t, d.IsFinished())
+	assert.NotNil(t, d.CanTransition(DeploymentRunning))
+
+	d.State = "bad_state"
+	assert.EqualError(t, d.Validate(), "Unknown deployment state: 'bad_state'")
+}
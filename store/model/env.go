@@ -0,0 +1,50 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"warden/utils"
+)
+
+// An environment variable passed to the instances of a project. Variables without an
+// alias apply to every alias of the project, those with an alias apply to that alias
+// only and take precedence. The Value of a secret variable is stored encrypted and is
+// never encoded to JSON
+type EnvVar struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	ProjectID uint      `json:"-" gorm:"unique_index:idx_env_var"`
+	Alias     string    `json:"alias" gorm:"type:varchar(100);unique_index:idx_env_var"`
+	Name      string    `json:"name" gorm:"type:varchar(255);unique_index:idx_env_var"`
+	Value     string    `json:"value" gorm:"type:text"`
+	Secret    bool      `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (e *EnvVar) Validate() error {
+	if e.ProjectID == 0 {
+		return errors.New("environment variable must be linked to a project via a project id key")
+	}
+	e.Alias = utils.StrLowerTrim(e.Alias)
+	if !buildArgRegex.MatchString(e.Name) {
+		return errors.Errorf("Environment variable '%s' is not a valid name", e.Name)
+	}
+	return nil
+}
+
+// Encodes the variable to JSON, leaving out the value of secrets
+func (e EnvVar) MarshalJSON() ([]byte, error) {
+	type envVar EnvVar // drops the methods so that it is encoded as usual
+	if e.Secret {
+		e.Value = ""
+	}
+	return json.Marshal(envVar(e))
+}
+
+// Reports whether the variable is passed to the instances of the alias
+func (e *EnvVar) AppliesTo(alias string) bool {
+	return e.Alias == "" || e.Alias == utils.StrLowerTrim(alias)
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvVar(t *testing.T) {
+	env := &EnvVar{Name: "API_TOKEN"}
+	assert.EqualError(t, env.Validate(), "environment variable must be linked to a project via a project id key")
+
+	env.ProjectID = 1
+	env.Alias = " Dev "
+	assert.Nil(t, env.Validate())
+	assert.Equal(t, "dev", env.Alias)
+	assert.True(t, env.AppliesTo("dev"))
+	assert.False(t, env.AppliesTo("latest"))
+	assert.True(t, (&EnvVar{}).AppliesTo("latest"))
+
+	env.Name = "API-TOKEN"
+	assert.EqualError(t, env.Validate(), "Environment variable 'API-TOKEN' is not a valid name")
+
+	env = &EnvVar{Name: "API_TOKEN", Value: "encrypted", Secret: true}
+	data, err := json.Marshal(env)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "encrypted")
+
+	env.Secret = false
+	data, err = json.Marshal(env)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"value":"encrypted"`)
+}
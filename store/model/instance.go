@@ -16,10 +16,33 @@ import (
 // Internally, the default empty string "" will be aliased to "latest"
 // as well.
 type Instance struct {
-	ID         uint   `json:"id" gorm:"primary_key"`
-	Alias      string `json:"alias" gorm:"unique_index:idx_alias_function"`
-	CommitHash string `json:"commit_hash" gorm:"column:commit_hash;varchar(100)"`
-	ProjectID  uint   `json:"project_id" gorm:"unique_index:idx_alias_function"`
+	ID              uint   `json:"id" gorm:"primary_key"`
+	Alias           string `json:"alias" gorm:"unique_index:idx_alias_function"`
+	CommitHash      string `json:"commit_hash" gorm:"column:commit_hash;varchar(100)"`
+	ProjectID       uint   `json:"project_id" gorm:"unique_index:idx_alias_function"`
+	MirrorAlias     string `json:"mirror_alias" gorm:"type:varchar(100)"` // alias of the project that receives a copy of the alias' requests
+	RuntimeSettings        // overrides the project's runtime settings
+	Resources              // overrides the project's resource limits
+	Replicas
+	TrafficSplit // sends a share of the alias' requests to other commits
+}
+
+// The bounds on the number of replicas running the instance. Leaving both at 0 runs a
+// single replica. A MinReplica of 0 stops the instance while it is idle and starts it
+// again on the next request
+type Replicas struct {
+	MinReplica int `json:"min_replica"`
+	MaxReplica int `json:"max_replica"`
+}
+
+func (r *Replicas) Validate() error {
+	if r.MinReplica < 0 || r.MaxReplica < 0 {
+		return errors.New("min and max replicas cannot be negative")
+	}
+	if r.MaxReplica < r.MinReplica {
+		return errors.New("max replica must be greater than or equal to min replica")
+	}
+	return nil
 }
 
 func (i *Instance) Validate() error {
@@ -36,5 +59,18 @@ func (i *Instance) Validate() error {
 	if i.ProjectID == 0 {
 		return errors.New("runtime instance must be linked to a project instance via a project id key")
 	}
-	return nil
+	if err := i.Replicas.Validate(); err != nil {
+		return err
+	}
+	if err := i.Resources.Validate(); err != nil {
+		return err
+	}
+	if err := i.TrafficSplit.Validate(i.CommitHash); err != nil {
+		return err
+	}
+	i.MirrorAlias = utils.StrLowerTrim(i.MirrorAlias)
+	if i.MirrorAlias == i.Alias {
+		return errors.Errorf("alias '%s' cannot mirror its requests to itself", i.Alias)
+	}
+	return i.RuntimeSettings.Validate()
 }
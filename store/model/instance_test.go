@@ -23,6 +23,24 @@ func TestInstance(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, inst.Alias, "dev")
 
+	inst.Replicas = Replicas{MinReplica: 0, MaxReplica: 2}
+	assert.Nil(t, inst.Validate())
+
+	inst.Replicas = Replicas{MinReplica: 2, MaxReplica: 1}
+	assert.EqualError(t, inst.Validate(), "max replica must be greater than or equal to min replica")
+
+	inst.Replicas = Replicas{MinReplica: -1}
+	assert.EqualError(t, inst.Validate(), "min and max replicas cannot be negative")
+
+	inst.Replicas = Replicas{}
+	inst.MirrorAlias = " Shadow "
+	assert.Nil(t, inst.Validate())
+	assert.Equal(t, "shadow", inst.MirrorAlias)
+
+	inst.MirrorAlias = "dev"
+	assert.EqualError(t, inst.Validate(), "alias 'dev' cannot mirror its requests to itself")
+
+	inst.MirrorAlias = ""
 	inst.ProjectID = 0
 	err = inst.Validate()
 	assert.EqualError(t, err, "runtime instance must be linked to a project instance via a project id key")
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+)
+
+// A MirrorResult compares the response to a request with the response of the shadow
+// alias the request was mirrored to. Bodies are compared by their size and hash
+type MirrorResult struct {
+	ID                  uint      `json:"id" gorm:"primary_key"`
+	ProjectID           uint      `json:"project_id" gorm:"index:idx_mirror_result"`
+	Alias               string    `json:"alias" gorm:"type:varchar(100);index:idx_mirror_result"`
+	MirrorAlias         string    `json:"mirror_alias" gorm:"type:varchar(100)"`
+	Method              string    `json:"method" gorm:"type:varchar(10)"`
+	Path                string    `json:"path" gorm:"type:varchar(2048)"`
+	Status              int       `json:"status"`
+	MirrorStatus        int       `json:"mirror_status"`
+	BodySize            int64     `json:"body_size"`
+	MirrorBodySize      int64     `json:"mirror_body_size"`
+	BodyHash            string    `json:"body_hash" gorm:"type:varchar(64)"`
+	MirrorBodyHash      string    `json:"mirror_body_hash" gorm:"type:varchar(64)"`
+	LatencyMillis       int64     `json:"latency_ms"`
+	MirrorLatencyMillis int64     `json:"mirror_latency_ms"`
+	Error               string    `json:"error" gorm:"type:varchar(2048)"`        // reason the alias did not respond, if any
+	MirrorError         string    `json:"mirror_error" gorm:"type:varchar(2048)"` // reason the shadow alias did not respond, if any
+	Match               bool      `json:"match"`                                  // whether both responded with the same status and body
+	CreatedAt           time.Time `json:"created_at"`
+}
@@ -21,6 +21,9 @@ type Project struct {
 	UniqueName  string     `gorm:"column:unique_name;type:varchar(100);unique;not null;index"`
 	Instances   []Instance `gorm:"foreignkey:ProjectID"` // must at least have one Instance. To run the latest
 	Owners      []User     `gorm:"many2many:user_project"`
+	Env         []EnvVar   `gorm:"foreignkey:ProjectID"` // secret values are left out when encoded to JSON
+	RuntimeSettings
+	Resources
 }
 
 func (p *Project) HasOwner(username string) bool {
@@ -48,5 +51,8 @@ func (p *Project) Validate() error {
 	}
 
 	p.UniqueName = p.GetUniqueName(p.Name)
-	return nil
+	if err := p.Resources.Validate(); err != nil {
+		return err
+	}
+	return p.RuntimeSettings.Validate()
 }
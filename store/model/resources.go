@@ -0,0 +1,63 @@
+package model
+
+import (
+	"github.com/pkg/errors"
+)
+
+// The limits on the resources each replica of a project can use. Instances inherit the
+// limits of their project and may override any of them. A limit of 0 is inherited from
+// the server's defaults, or left unlimited if there are none
+type Resources struct {
+	Memory       int64 `json:"memory"`         // memory limit in bytes
+	CPUShares    int64 `json:"cpu_shares"`     // CPU weight relative to other replicas. 1024 is the weight of a full CPU
+	CPUQuota     int64 `json:"cpu_quota"`      // CPU time in microseconds per 100ms period. 100000 is a full CPU
+	PidsLimit    int64 `json:"pids_limit"`     // maximum number of processes
+	MaxOpenFiles int64 `json:"max_open_files"` // maximum number of open file descriptors
+}
+
+func (r *Resources) Validate() error {
+	if r.Memory < 0 || r.CPUShares < 0 || r.CPUQuota < 0 || r.PidsLimit < 0 || r.MaxOpenFiles < 0 {
+		return errors.New("resource limits cannot be negative")
+	}
+	if r.CPUQuota > 0 && r.CPUQuota < 1000 {
+		return errors.Errorf("CPU quota of %dus is below the minimum of 1000us", r.CPUQuota)
+	}
+	return nil
+}
+
+// Returns the limits with the non-zero limits of the override applied
+func (r Resources) Merge(override Resources) Resources {
+	if override.Memory != 0 {
+		r.Memory = override.Memory
+	}
+	if override.CPUShares != 0 {
+		r.CPUShares = override.CPUShares
+	}
+	if override.CPUQuota != 0 {
+		r.CPUQuota = override.CPUQuota
+	}
+	if override.PidsLimit != 0 {
+		r.PidsLimit = override.PidsLimit
+	}
+	if override.MaxOpenFiles != 0 {
+		r.MaxOpenFiles = override.MaxOpenFiles
+	}
+	return r
+}
+
+// Returns the limits lowered to the non-zero limits of the max. Unlimited resources
+// are set to the max
+func (r Resources) Cap(max Resources) Resources {
+	capLimit(&r.Memory, max.Memory)
+	capLimit(&r.CPUShares, max.CPUShares)
+	capLimit(&r.CPUQuota, max.CPUQuota)
+	capLimit(&r.PidsLimit, max.PidsLimit)
+	capLimit(&r.MaxOpenFiles, max.MaxOpenFiles)
+	return r
+}
+
+func capLimit(limit *int64, max int64) {
+	if max > 0 && (*limit == 0 || *limit > max) {
+		*limit = max
+	}
+}
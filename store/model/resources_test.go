@@ -0,0 +1,21 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResources(t *testing.T) {
+	assert.Nil(t, (&Resources{}).Validate())
+	assert.Nil(t, (&Resources{Memory: 1 << 28, CPUQuota: 50000}).Validate())
+	assert.EqualError(t, (&Resources{PidsLimit: -1}).Validate(), "resource limits cannot be negative")
+	assert.EqualError(t, (&Resources{CPUQuota: 999}).Validate(), "CPU quota of 999us is below the minimum of 1000us")
+
+	project := Resources{Memory: 1 << 28, CPUShares: 512}
+	merged := project.Merge(Resources{Memory: 1 << 29, PidsLimit: 100})
+	assert.Equal(t, Resources{Memory: 1 << 29, CPUShares: 512, PidsLimit: 100}, merged)
+
+	capped := merged.Cap(Resources{Memory: 1 << 28, CPUQuota: 100000, PidsLimit: 200})
+	assert.Equal(t, Resources{Memory: 1 << 28, CPUShares: 512, CPUQuota: 100000, PidsLimit: 100}, capped)
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"warden/docker/templates"
+	"warden/utils"
+)
+
+var buildArgRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Build arguments passed to the image build. These are stored as a JSON object
+type BuildArgs map[string]string
+
+// Scans the JSON object stored in the database into the BuildArgs
+func (b *BuildArgs) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*b = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into build args", value)
+	}
+	if len(data) == 0 {
+		*b = nil
+		return nil
+	}
+	return json.Unmarshal(data, b)
+}
+
+// Converts the BuildArgs into a JSON object for storage
+func (b BuildArgs) Value() (driver.Value, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "error serializing build args")
+	}
+	return string(data), nil
+}
+
+// The settings used to build the image of a project. Instances inherit the settings
+// of their project and may override any of them. The Runtime must be the name of a
+// template registered in the templates Box
+type RuntimeSettings struct {
+	Runtime   string    `json:"runtime" gorm:"type:varchar(50)"`     // runtime environment. i.e. python
+	Handler   string    `json:"handler" gorm:"type:varchar(255)"`    // entrypoint of the function. i.e. main.entry_func
+	BaseImage string    `json:"base_image" gorm:"type:varchar(255)"` // overrides the runtime template's base image
+	BuildArgs BuildArgs `json:"build_args" gorm:"type:text"`         // build arguments passed to the image build
+}
+
+// Validates the settings. Empty settings are valid as they are inherited or
+// overridden when merged
+func (r *RuntimeSettings) Validate() error {
+	r.Runtime = utils.StrLowerTrim(r.Runtime)
+	if r.Runtime != "" {
+		box, err := templates.NewBox()
+		if err != nil {
+			return err
+		}
+		if !box.HasTemplate(r.Runtime) {
+			return errors.Errorf("Unknown runtime '%s'. Runtime must be one of: %s", r.Runtime, strings.Join(box.Names(), ", "))
+		}
+		r.Runtime = box.Resolve(r.Runtime)
+	}
+
+	r.Handler = strings.TrimSpace(r.Handler)
+	if strings.ContainsAny(r.Handler, " \t\n") {
+		return errors.Errorf("Handler '%s' must not contain whitespace", r.Handler)
+	}
+
+	r.BaseImage = strings.TrimSpace(r.BaseImage)
+	if strings.ContainsAny(r.BaseImage, " \t\n") {
+		return errors.Errorf("Base image '%s' must not contain whitespace", r.BaseImage)
+	}
+
+	for name := range r.BuildArgs {
+		if !buildArgRegex.MatchString(name) {
+			return errors.Errorf("Build arg '%s' is not a valid name", name)
+		}
+	}
+	return nil
+}
+
+// Returns the settings with the non-empty fields of the override applied. Build
+// args are merged, with the override's values taking precedence
+func (r RuntimeSettings) Merge(override RuntimeSettings) RuntimeSettings {
+	if override.Runtime != "" {
+		r.Runtime = override.Runtime
+	}
+	if override.Handler != "" {
+		r.Handler = override.Handler
+	}
+	if override.BaseImage != "" {
+		r.BaseImage = override.BaseImage
+	}
+	if len(override.BuildArgs) > 0 {
+		args := make(BuildArgs, len(r.BuildArgs)+len(override.BuildArgs))
+		for k, v := range r.BuildArgs {
+			args[k] = v
+		}
+		for k, v := range override.BuildArgs {
+			args[k] = v
+		}
+		r.BuildArgs = args
+	}
+	return r
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeSettings(t *testing.T) {
+	settings := &RuntimeSettings{
+		Runtime:   "  Python ",
+		Handler:   " main.handler ",
+		BuildArgs: BuildArgs{"PIP_INDEX": "https://pypi.org/simple"},
+	}
+	err := settings.Validate()
+	assert.Nil(t, err)
+	assert.Equal(t, settings.Runtime, "python")
+	assert.Equal(t, settings.Handler, "main.handler")
+
+	err = (&RuntimeSettings{}).Validate()
+	assert.Nil(t, err)
+
+	// aliases are stored as the runtime they stand for
+	alias := &RuntimeSettings{Runtime: "Python3"}
+	assert.Nil(t, alias.Validate())
+	assert.Equal(t, alias.Runtime, "python")
+
+	err = (&RuntimeSettings{Runtime: "cobol"}).Validate()
+	assert.EqualError(t, err, "Unknown runtime 'cobol'. Runtime must be one of: python")
+
+	err = (&RuntimeSettings{Handler: "main handler"}).Validate()
+	assert.EqualError(t, err, "Handler 'main handler' must not contain whitespace")
+
+	err = (&RuntimeSettings{BuildArgs: BuildArgs{"1BAD": "value"}}).Validate()
+	assert.EqualError(t, err, "Build arg '1BAD' is not a valid name")
+
+	merged := settings.Merge(RuntimeSettings{
+		Handler:   "other.handler",
+		BuildArgs: BuildArgs{"DEBUG": "1"},
+	})
+	assert.Equal(t, merged.Runtime, "python")
+	assert.Equal(t, merged.Handler, "other.handler")
+	assert.Equal(t, merged.BuildArgs, BuildArgs{"PIP_INDEX": "https://pypi.org/simple", "DEBUG": "1"})
+	assert.Len(t, settings.BuildArgs, 1) // original is left untouched
+}
+
+func TestBuildArgs(t *testing.T) {
+	args := BuildArgs{"KEY": "value"}
+	v, err := args.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, v, `{"KEY":"value"}`)
+
+	var scanned BuildArgs
+	assert.Nil(t, scanned.Scan([]byte(`{"KEY":"value"}`)))
+	assert.Equal(t, scanned, args)
+
+	assert.Nil(t, scanned.Scan(nil))
+	assert.Nil(t, scanned)
+}
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"warden/utils"
+)
+
+// A commit that receives a share of an alias' requests
+type SplitTarget struct {
+	CommitHash string `json:"commit_hash"`
+	Weight     int    `json:"weight"` // percent of the alias' requests sent to the commit
+}
+
+// The commits that receive a share of an alias' requests. These are stored as a JSON
+// array
+type Split []SplitTarget
+
+// Scans the JSON array stored in the database into the Split
+func (s *Split) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into traffic split", value)
+	}
+	if len(data) == 0 {
+		*s = nil
+		return nil
+	}
+	return json.Unmarshal(data, s)
+}
+
+// Converts the Split into a JSON array for storage
+func (s Split) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "error serializing traffic split")
+	}
+	return string(data), nil
+}
+
+// Sends a share of an alias' requests to other commits of the project, i.e. to try out
+// a new commit on a few requests before the alias is pointed to it. Each commit must
+// be deployed by another instance of the project. The requests that are not sent to
+// one of the commits go to the alias' own commit.
+//
+// Requests are assigned at random unless they carry the StickyHeader or StickyCookie,
+// in which case requests with the same value are always sent to the same commit. The
+// header is used if a request has both
+type TrafficSplit struct {
+	Split        Split  `json:"split" gorm:"type:text"`
+	StickyHeader string `json:"sticky_header" gorm:"type:varchar(255)"`
+	StickyCookie string `json:"sticky_cookie" gorm:"type:varchar(255)"`
+}
+
+// Checks if the commit is one of the split's targets. The hashes match if one is a
+// prefix of the other as either may be abbreviated
+func (s Split) Contains(commitHash string) bool {
+	commitHash = utils.StrLowerTrim(commitHash)
+	if commitHash == "" {
+		return false
+	}
+	for _, t := range s {
+		if strings.HasPrefix(commitHash, t.CommitHash) || strings.HasPrefix(t.CommitHash, commitHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the split of the alias serving the commit
+func (t *TrafficSplit) Validate(commitHash string) error {
+	total := 0
+	seen := make(map[string]bool)
+	for i := range t.Split {
+		s := &t.Split[i]
+		s.CommitHash = utils.StrLowerTrim(s.CommitHash)
+		if s.CommitHash == "" {
+			return errors.New("commit hash of traffic split cannot be empty")
+		}
+		if s.CommitHash == commitHash {
+			return errors.Errorf("commit '%s' already serves the alias and cannot be part of its traffic split", s.CommitHash)
+		}
+		if seen[s.CommitHash] {
+			return errors.Errorf("commit '%s' is in the traffic split more than once", s.CommitHash)
+		}
+		seen[s.CommitHash] = true
+
+		if s.Weight <= 0 || s.Weight > 100 {
+			return errors.Errorf("weight of commit '%s' must be between 1 and 100", s.CommitHash)
+		}
+		total += s.Weight
+	}
+	if total > 100 {
+		return errors.Errorf("weights of the traffic split add up to %d, which is more than 100", total)
+	}
+
+	t.StickyHeader = http.CanonicalHeaderKey(strings.TrimSpace(t.StickyHeader))
+	t.StickyCookie = strings.TrimSpace(t.StickyCookie)
+	return nil
+}
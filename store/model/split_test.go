@@ -0,0 +1,50 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficSplit(t *testing.T) {
+	split := TrafficSplit{
+		Split:        Split{{CommitHash: " 0C0AAFA ", Weight: 5}, {CommitHash: "1d2e3f4", Weight: 20}},
+		StickyHeader: " x-user-id ",
+	}
+	assert.Nil(t, split.Validate("95bfc35"))
+	assert.Equal(t, "0c0aafa", split.Split[0].CommitHash)
+	assert.Equal(t, "X-User-Id", split.StickyHeader)
+
+	split.Split[1].Weight = 96
+	assert.EqualError(t, split.Validate("95bfc35"), "weights of the traffic split add up to 101, which is more than 100")
+
+	split.Split[1].Weight = 0
+	assert.EqualError(t, split.Validate("95bfc35"), "weight of commit '1d2e3f4' must be between 1 and 100")
+
+	split.Split[1] = SplitTarget{CommitHash: "0c0aafa", Weight: 1}
+	assert.EqualError(t, split.Validate("95bfc35"), "commit '0c0aafa' is in the traffic split more than once")
+
+	assert.EqualError(t, split.Validate("0c0aafa"), "commit '0c0aafa' already serves the alias and cannot be part of its traffic split")
+}
+
+func TestSplit_Contains(t *testing.T) {
+	split := Split{{CommitHash: "0c0aafa", Weight: 5}}
+	assert.True(t, split.Contains("0c0aafa"))
+	assert.True(t, split.Contains(" 0C0AAFA95bfc3515452bfafeb2e04f948ac26d1 "))
+	assert.True(t, split.Contains("0c0a"))
+	assert.False(t, split.Contains("95bfc35"))
+	assert.False(t, split.Contains(""))
+}
+
+func TestSplit_Scan(t *testing.T) {
+	split := Split{{CommitHash: "0c0aafa", Weight: 5}}
+	value, err := split.Value()
+	assert.Nil(t, err)
+
+	var scanned Split
+	assert.Nil(t, scanned.Scan(value))
+	assert.Equal(t, split, scanned)
+
+	assert.Nil(t, scanned.Scan(nil))
+	assert.Nil(t, scanned)
+}
@@ -10,12 +10,14 @@ import (
 )
 
 // Creates a new project. Returns an error if creation fails
-func (s *Store) ProjectCreate(gitUrl, name, description string, user model.User) (*model.Project, error) {
+func (s *Store) ProjectCreate(gitUrl, name, description string, settings model.RuntimeSettings, resources model.Resources, user model.User) (*model.Project, error) {
 	project := &model.Project{
-		GitURL:      gitUrl,
-		Name:        name,
-		Description: description,
-		Owners:      []model.User{user},
+		GitURL:          gitUrl,
+		Name:            name,
+		Description:     description,
+		Owners:          []model.User{user},
+		RuntimeSettings: settings,
+		Resources:       resources,
 	}
 
 	if err := project.Validate(); err != nil {
@@ -36,6 +38,15 @@ func (s *Store) ProjectDelete(name string) error {
 		return err
 	}
 
+	if err := s.db.Where("project_id = ?", project.ID).Delete(&model.EnvVar{}).Error; err != nil {
+		return errors.Wrapf(err, "error removing environment variables of project")
+	}
+	if err := s.db.Where("project_id = ?", project.ID).Delete(&model.AliasAssignment{}).Error; err != nil {
+		return errors.Wrapf(err, "error removing alias history of project")
+	}
+	if err := s.db.Where("project_id = ?", project.ID).Delete(&model.MirrorResult{}).Error; err != nil {
+		return errors.Wrapf(err, "error removing mirror results of project")
+	}
 	if err := s.db.Delete(project).Error; err != nil {
 		return errors.Wrapf(err, "error removing project")
 	}
@@ -45,7 +56,7 @@ func (s *Store) ProjectDelete(name string) error {
 // Searches for a project by it's ID. Returns an error if query fails
 func (s *Store) ProjectGetById(id uint) (*model.Project, error) {
 	var project model.Project
-	if err := s.db.Preload(_OWNERS).Preload(_INSTANCES).First(&project, id).Error; err == gorm.ErrRecordNotFound {
+	if err := s.db.Preload(_OWNERS).Preload(_INSTANCES).Preload(_ENV).First(&project, id).Error; err == gorm.ErrRecordNotFound {
 		return nil, err
 	} else if err != nil {
 		return nil, errors.Wrapf(err, "could not find project with id: %d", id)
@@ -56,7 +67,7 @@ func (s *Store) ProjectGetById(id uint) (*model.Project, error) {
 // Searches for a project by it's name. Returns an error if query fails
 func (s *Store) ProjectGetByName(name string) (*model.Project, error) {
 	var project model.Project
-	if err := s.db.Preload(_OWNERS).Preload(_INSTANCES).First(&project, "unique_name = ?", project.GetUniqueName(name)).Error; err == gorm.ErrRecordNotFound {
+	if err := s.db.Preload(_OWNERS).Preload(_INSTANCES).Preload(_ENV).First(&project, "unique_name = ?", project.GetUniqueName(name)).Error; err == gorm.ErrRecordNotFound {
 		return nil, err
 	} else if err != nil {
 		return nil, errors.Wrapf(err, "could not find project with name: %s", name)
@@ -66,7 +77,7 @@ func (s *Store) ProjectGetByName(name string) (*model.Project, error) {
 
 // Lists all projects. This is normally used by admins since it'll list all projects
 func (s *Store) ProjectList() (projects []model.Project, err error) {
-	if err := s.db.Preload(_OWNERS).Preload(_INSTANCES).Find(&projects).Error; err != nil {
+	if err := s.db.Preload(_OWNERS).Preload(_INSTANCES).Preload(_ENV).Find(&projects).Error; err != nil {
 		return nil, errors.Wrap(err, "could not list projects")
 	}
 	return
@@ -105,6 +116,8 @@ func (s *Store) ProjectUpdate(newProj *model.Project) (*model.Project, error) {
 	project.UniqueName = newProj.GetUniqueName(project.Name)
 	project.Description = newProj.Description
 	project.GitURL = newProj.GitURL
+	project.RuntimeSettings = newProj.RuntimeSettings
+	project.Resources = newProj.Resources
 	if newProj.Owners != nil && len(newProj.Owners) > 0 {
 		project.Owners = newProj.Owners
 	}
@@ -5,6 +5,8 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
+
+	"warden/store/model"
 )
 
 func TestProject(t *testing.T) {
@@ -17,10 +19,13 @@ func TestProject(t *testing.T) {
 	err = user.Validate()
 	assert.Nil(t, err)
 
-	proj, err := S.ProjectCreate("https://github.com/kantopark/warden.git", "test_project_2", "description", *user)
+	proj, err := S.ProjectCreate("https://github.com/kantopark/warden.git", "test_project_2", "description", model.RuntimeSettings{}, model.Resources{}, *user)
 	assert.Nil(t, err)
 	assert.NotNil(t, proj)
 
+	_, err = S.ProjectCreate("https://github.com/kantopark/warden.git", "test_project_3", "description", model.RuntimeSettings{Runtime: "cobol"}, model.Resources{}, *user)
+	assert.EqualError(t, err, "Unknown runtime 'cobol'. Runtime must be one of: python")
+
 	projects, err = S.ProjectList()
 	assert.Nil(t, err)
 	assert.Len(t, projects, 2)
@@ -46,15 +51,22 @@ func TestProject(t *testing.T) {
 	assert.EqualError(t, err, gorm.ErrRecordNotFound.Error())
 
 	proj.Description = "new description"
+	proj.Runtime = "python"
+	proj.BuildArgs = model.BuildArgs{"DEBUG": "1"}
 	proj, err = S.ProjectUpdate(proj)
 	assert.Nil(t, err)
 	assert.Equal(t, proj.Description, "new description")
+	assert.Equal(t, proj.Runtime, "python")
+
+	proj, err = S.ProjectGetById(proj.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, proj.BuildArgs, model.BuildArgs{"DEBUG": "1"})
 
 	proj.ID = 0
 	_, err = S.ProjectUpdate(proj)
 	assert.EqualError(t, err, "id of project to update must be specified")
 
-	err = S.ProjectDelete(proj.Name, *user)
+	err = S.ProjectDelete(proj.Name)
 	assert.Nil(t, err)
 
 	projects, err = S.ProjectList()
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Derives the AES-256 key used to encrypt secrets from the configured key. Returns nil
+// if no key is configured, in which case secrets cannot be stored
+func secretKey(key string) []byte {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// Encrypts the value with AES-GCM. The random nonce is prepended to the ciphertext
+// and the result is base64 encoded for storage
+func (s *Store) encrypt(value string) (string, error) {
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "error generating nonce")
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a value encrypted by encrypt
+func (s *Store) decrypt(value string) (string, error) {
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding secret")
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("secret is too short to have been encrypted")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error decrypting secret. Has store.secret_key changed?")
+	}
+	return string(plain), nil
+}
+
+func (s *Store) cipher() (cipher.AEAD, error) {
+	if s.secretKey == nil {
+		return nil, errors.New("store.secret_key must be set to store secrets")
+	}
+	block, err := aes.NewCipher(s.secretKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating cipher")
+	}
+	return cipher.NewGCM(block)
+}
@@ -18,11 +18,13 @@ const (
 	_INSTANCES = "Instances"
 	_PROJECTS  = "Projects"
 	_OWNERS    = "Owners"
+	_ENV       = "Env"
 )
 
 // A store used to carry information on the functions.
 type Store struct {
-	db *gorm.DB
+	db        *gorm.DB
+	secretKey []byte // encrypts the secret environment variables
 }
 
 var store *Store
@@ -44,7 +46,7 @@ func NewStore() (*Store, error) {
 
 		db.LogMode(viper.GetBool("store.log_mode"))
 
-		store = &Store{db}
+		store = &Store{db: db, secretKey: secretKey(viper.GetString("store.secret_key"))}
 		store.registerModels()
 	})
 
@@ -56,6 +58,12 @@ func (s *Store) registerModels() {
 	s.CreateTableIfNotExists(&model.User{})
 	s.CreateTableIfNotExists(&model.Project{})
 	s.CreateTableIfNotExists(&model.Instance{})
+	s.CreateTableIfNotExists(&model.Deployment{})
+	s.CreateTableIfNotExists(&model.DeploymentEvent{})
+	s.CreateTableIfNotExists(&model.DeploymentLog{})
+	s.CreateTableIfNotExists(&model.EnvVar{})
+	s.CreateTableIfNotExists(&model.AliasAssignment{})
+	s.CreateTableIfNotExists(&model.MirrorResult{})
 }
 
 // Creates table if it doesn't exist. Else migrates the table to the latest state.
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"warden/config"
+	"warden/store/model"
 )
 
 var (
@@ -21,6 +22,7 @@ func init() {
 	config.ReadConfig()
 	viper.Set("store.dsn", "file:memdb1?mode=memory&cache=shared")
 	viper.Set("store.dialect", "sqlite3")
+	viper.Set("store.secret_key", "test-secret-key")
 
 	S, err = NewStore()
 	if err != nil {
@@ -40,12 +42,14 @@ func init() {
 		"https://github.com/kantopark-tpl/python-simple",
 		"python-test",
 		"A simple description",
+		model.RuntimeSettings{Runtime: "python", Handler: "main.handler"},
+		model.Resources{},
 		*user)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	_, err = S.InstanceCreate("95bfc3515452bfafeb2e04f948ac26d1e2a871c8", "test", project.Name)
+	_, err = S.InstanceCreate(model.Instance{CommitHash: "95bfc3515452bfafeb2e04f948ac26d1e2a871c8", Alias: "test"}, project.Name)
 	if err != nil {
 		log.Fatalln(err)
 	}